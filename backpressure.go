@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tracks Evergreen's pending bytes cap, so no retrieval is started for a piece that could never be requested
+// BytesPendingCurrent/BytesPendingMax come from RequestDeal responses, and the proposals poller is used to
+// notice when proposals get consumed while we are paused
+type pendingBytesTracker struct {
+	mu sync.Mutex
+
+	current   int64
+	max       int64
+	updatedAt time.Time
+	paused    bool
+
+	// Pieces being retrieved or imported that haven't been requested from Evergreen yet
+	inFlight map[string]int64
+}
+
+var pendingBytes = &pendingBytesTracker{inFlight: make(map[string]int64)}
+
+func (p *pendingBytesTracker) inFlightBytes() int64 {
+	var total int64 = 0
+	for _, size := range p.inFlight {
+		total += size
+	}
+	return total
+}
+
+// Bytes that can still be started before hitting the Evergreen cap
+// Returns false if the cap is not known yet, ie: no deal has been requested so far
+func (p *pendingBytesTracker) Headroom() (int64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.headroom()
+}
+
+func (p *pendingBytesTracker) headroom() (int64, bool) {
+	if p.max <= 0 {
+		return 0, false
+	}
+	return p.max - p.current - p.inFlightBytes(), true
+}
+
+// Reserves room for a piece under the pending bytes cap. Returns false if it would go over
+func (p *pendingBytesTracker) reserve(pieceCid string, size int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	headroom, known := p.headroom()
+	if known && size > headroom {
+		if !p.paused {
+			log.Infof("pausing new retrievals: %d pending + %d in flight bytes, max %d", p.current, p.inFlightBytes(), p.max)
+			p.paused = true
+		}
+		return false
+	}
+
+	if p.paused {
+		log.Infof("resuming retrievals: %d bytes of headroom", headroom)
+		p.paused = false
+	}
+
+	p.inFlight[pieceCid] = size
+	return true
+}
+
+// Drops the reservation for a piece. Safe to call more than once
+func (p *pendingBytesTracker) release(pieceCid string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.inFlight, pieceCid)
+}
+
+// Records the pending bytes from a RequestDeal response. The piece is now counted by Evergreen itself
+func (p *pendingBytesTracker) requested(pieceCid string, r DealResponse) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.inFlight, pieceCid)
+	p.current = r.BytesPendingCurrent
+	p.max = r.BytesPendingMax
+	p.updatedAt = time.Now()
+
+	headroom, _ := p.headroom()
+	log.Debugf("evergreen pending bytes %d of %d, headroom %d", p.current, p.max, headroom)
+}
+
+// Recomputes the pending bytes from the list of proposals that have not been imported yet
+func (p *pendingBytesTracker) updateFromProposals(proposals []PendingProposal) {
+	var total int64 = 0
+	for _, proposal := range proposals {
+		total += proposal.PieceSize
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.current = total
+	p.updatedAt = time.Now()
+}
+
+// Returns true while new retrievals are paused on the pending bytes cap
+func (p *pendingBytesTracker) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPendingBytesBackpressure(t *testing.T) {
+	p := &pendingBytesTracker{inFlight: make(map[string]int64)}
+
+	if !p.reserve("a", 100) {
+		t.Fatal("reservations should be allowed while the cap is unknown")
+	}
+
+	p.requested("a", DealResponse{BytesPendingCurrent: 100, BytesPendingMax: 250})
+
+	if !p.reserve("b", 100) {
+		t.Fatal("piece within the headroom should be allowed")
+	}
+	if p.reserve("c", 100) {
+		t.Fatal("piece going over the cap with in-flight bytes should be refused")
+	}
+
+	p.release("b")
+	p.release("b")
+	if headroom, _ := p.Headroom(); headroom != 150 {
+		t.Errorf("expected 150 bytes of headroom, got %d", headroom)
+	}
+
+	// Proposals got consumed, leaving nothing pending
+	p.updateFromProposals(nil)
+	if !p.reserve("c", 200) || p.paused {
+		t.Error("retrievals should resume once proposals are consumed")
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Consecutive failures before a breaker opens
+const (
+	providerBreakerThreshold = 5
+	pieceBreakerThreshold    = 3
+	pairBreakerThreshold     = 2
+)
+
+// How long a half-open breaker waits for its probe to report back before letting another one through
+const breakerProbeTimeout = time.Hour
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+// Counts consecutive failures of a provider, piece or (piece, provider) pair. Once it reaches the
+// threshold the breaker opens for a cool-down that doubles with every further failure. When the
+// cool-down runs out it is half-open, and lets a single probe through to decide whether to close again
+type circuitBreaker struct {
+	Failures   int       `json:"failures"`
+	OpenUntil  time.Time `json:"open_until"`
+	ProbeUntil time.Time `json:"probe_until"` // A probe is in flight until then
+}
+
+func (b *circuitBreaker) state(now time.Time) breakerState {
+	switch {
+	case b.OpenUntil.IsZero():
+		return breakerClosed
+	case now.Before(b.OpenUntil):
+		return breakerOpen
+	default:
+		return breakerHalfOpen
+	}
+}
+
+// A piece that failed from every one of its sources. It is skipped, apart from a probe every probe interval
+type unretrievablePiece struct {
+	Since     time.Time `json:"since"`
+	Probes    int       `json:"probes"`
+	NextProbe time.Time `json:"next_probe"`
+}
+
+type breakerStates struct {
+	Providers     map[string]*circuitBreaker     `json:"providers"`
+	Pieces        map[string]*circuitBreaker     `json:"pieces"`
+	Pairs         map[string]*circuitBreaker     `json:"pairs"`
+	Unretrievable map[string]*unretrievablePiece `json:"unretrievable"`
+}
+
+// Circuit breakers for source providers, pieces and (piece, provider) pairs
+// Open breakers are saved with the time they open until, so a restart doesn't retry a bad SP straight away
+type breakerBoard struct {
+	mu sync.Mutex
+
+	states        breakerStates
+	cooldown      time.Duration
+	maxCooldown   time.Duration
+	probeInterval time.Duration
+	state         *persistedState
+
+	tried map[string]bool // Pieces being attempted that a source has been tried for
+}
+
+var sourceBreakers = newBreakerBoard(10*time.Minute, 48*time.Hour, 24*time.Hour)
+
+func newBreakerBoard(cooldown time.Duration, maxCooldown time.Duration, probeInterval time.Duration) *breakerBoard {
+	b := &breakerBoard{
+		states:        emptyBreakerStates(),
+		cooldown:      cooldown,
+		maxCooldown:   maxCooldown,
+		probeInterval: probeInterval,
+		tried:         make(map[string]bool),
+	}
+	b.state = newPersistedState("breakers.json", &b.mu, &b.states, stateSaveDelay)
+	return b
+}
+
+func emptyBreakerStates() breakerStates {
+	return breakerStates{
+		Providers:     make(map[string]*circuitBreaker),
+		Pieces:        make(map[string]*circuitBreaker),
+		Pairs:         make(map[string]*circuitBreaker),
+		Unretrievable: make(map[string]*unretrievablePiece),
+	}
+}
+
+// Loads the cool-downs from config, and the breaker states from the state directory
+func InitBreakers(cfg EvergreenDealbotConfig) error {
+	b := sourceBreakers
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cooldown = time.Duration(cfg.Evergreen.BreakerCooldown) * time.Minute
+	b.maxCooldown = time.Duration(cfg.Evergreen.BreakerMaxCooldown) * time.Hour
+	b.probeInterval = time.Duration(cfg.Evergreen.UnretrievableProbeInterval) * time.Hour
+
+	if err := b.state.load(cfg.Common.StateLocation); err != nil {
+		return err
+	}
+
+	// Maps missing from the state file are left nil
+	empty := emptyBreakerStates()
+	if b.states.Providers == nil {
+		b.states.Providers = empty.Providers
+	}
+	if b.states.Pieces == nil {
+		b.states.Pieces = empty.Pieces
+	}
+	if b.states.Pairs == nil {
+		b.states.Pairs = empty.Pairs
+	}
+	if b.states.Unretrievable == nil {
+		b.states.Unretrievable = empty.Unretrievable
+	}
+	return nil
+}
+
+func pairKey(pieceCid string, sp string) string {
+	return pieceCid + "/" + sp
+}
+
+// Whether a breaker lets an attempt through. A half-open breaker lets one through at a time
+func (b *breakerBoard) permits(breakers map[string]*circuitBreaker, key string, now time.Time) bool {
+	cb, found := breakers[key]
+	if !found {
+		return true
+	}
+
+	switch cb.state(now) {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		return !now.Before(cb.ProbeUntil)
+	default:
+		return true
+	}
+}
+
+// Marks a half-open breaker's probe as in flight, so no other attempt goes through until it reports back
+func (b *breakerBoard) startProbe(breakers map[string]*circuitBreaker, key string, now time.Time) {
+	if cb, found := breakers[key]; found && cb.state(now) == breakerHalfOpen {
+		cb.ProbeUntil = now.Add(breakerProbeTimeout)
+	}
+}
+
+// Lets another probe through a half-open breaker, when the one in flight ended without an outcome
+func (b *breakerBoard) endProbe(breakers map[string]*circuitBreaker, key string) {
+	if cb, found := breakers[key]; found {
+		cb.ProbeUntil = time.Time{}
+	}
+}
+
+// Counts a failure, opening the breaker with a doubled cool-down once it has failed threshold times in a row
+func (b *breakerBoard) fail(breakers map[string]*circuitBreaker, level string, key string, threshold int, now time.Time) {
+	cb, found := breakers[key]
+	if !found {
+		cb = &circuitBreaker{}
+		breakers[key] = cb
+	}
+	cb.Failures++
+	cb.ProbeUntil = time.Time{}
+
+	if cb.Failures < threshold {
+		return
+	}
+
+	cooldown := b.cooldown
+	for i := threshold; i < cb.Failures && cooldown < b.maxCooldown; i++ {
+		cooldown *= 2
+	}
+	if cooldown > b.maxCooldown {
+		cooldown = b.maxCooldown
+	}
+	cb.OpenUntil = now.Add(cooldown)
+	log.Infof("circuit breaker for %s %s opened for %v after %d failures in a row", level, key, cooldown, cb.Failures)
+}
+
+func (b *breakerBoard) succeed(breakers map[string]*circuitBreaker, level string, key string) {
+	cb, found := breakers[key]
+	if !found {
+		return
+	}
+	if !cb.OpenUntil.IsZero() {
+		log.Infof("circuit breaker for %s %s closed", level, key)
+	}
+	delete(breakers, key)
+}
+
+// Whether a piece is worth attempting: its breaker lets an attempt through and so do the breakers of at
+// least one of its sources, or it is an unretrievable piece due its periodic probe. Nothing is marked as
+// in flight, see startSource
+func (b *breakerBoard) pieceAllowed(pieceCid string, sources []Source) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if u, found := b.states.Unretrievable[pieceCid]; found {
+		return !now.Before(u.NextProbe)
+	}
+	if !b.permits(b.states.Pieces, pieceCid, now) {
+		return false
+	}
+	for _, source := range sources {
+		if b.permits(b.states.Pairs, pairKey(pieceCid, source.ProviderID), now) && b.permits(b.states.Providers, source.ProviderID, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Starts an attempt at a piece, returning its sources whose breakers let an attempt through
+// An unretrievable piece is probed from all of the sources whose provider breakers allow it
+// Nothing is marked as in flight until a source is actually tried, see startSource
+func (b *breakerBoard) startPiece(pieceCid string, sources []Source) []Source {
+	if b == nil {
+		return sources
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	delete(b.tried, pieceCid)
+	_, probe := b.states.Unretrievable[pieceCid]
+
+	var allowed []Source
+	for _, source := range sources {
+		if !probe && !b.permits(b.states.Pairs, pairKey(pieceCid, source.ProviderID), now) {
+			log.Debugf("circuit breaker for %s from %s is open", pieceCid, source.ProviderID)
+			continue
+		}
+		if !b.permits(b.states.Providers, source.ProviderID, now) {
+			log.Debugf("circuit breaker for SP %s is open", source.ProviderID)
+			continue
+		}
+		allowed = append(allowed, source)
+	}
+	return allowed
+}
+
+// Called right before a piece is retrieved from a provider. Returns false if the breakers no longer let
+// the attempt through, e.g. because another piece is probing the provider. Otherwise the half-open
+// breakers involved are marked as probing, until the outcome is recorded or the attempt abandoned
+func (b *breakerBoard) startSource(pieceCid string, sp string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	pair := pairKey(pieceCid, sp)
+	u, probe := b.states.Unretrievable[pieceCid]
+	if (!probe && !b.permits(b.states.Pairs, pair, now)) || !b.permits(b.states.Providers, sp, now) {
+		log.Debugf("circuit breakers no longer allow %s from %s", pieceCid, sp)
+		return false
+	}
+
+	if !b.tried[pieceCid] {
+		b.tried[pieceCid] = true
+		if probe {
+			u.Probes++
+			u.NextProbe = now.Add(b.probeInterval)
+			log.Infof("probing unretrievable piece %s, unretrievable since %v", pieceCid, u.Since.Format(time.RFC3339))
+		} else {
+			b.startProbe(b.states.Pieces, pieceCid, now)
+		}
+	}
+	if !probe {
+		b.startProbe(b.states.Pairs, pair, now)
+	}
+	b.startProbe(b.states.Providers, sp, now)
+	b.state.changed()
+	return true
+}
+
+// Records an attempt started with startSource that ended without saying anything about the provider,
+// e.g. because it was cancelled or we refused its offer
+func (b *breakerBoard) sourceAbandoned(pieceCid string, sp string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.endProbe(b.states.Pairs, pairKey(pieceCid, sp))
+	b.endProbe(b.states.Providers, sp)
+	b.state.changed()
+}
+
+// Records a failed retrieval of a piece from a provider
+func (b *breakerBoard) sourceFailed(pieceCid string, sp string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.fail(b.states.Pairs, "piece from SP", pairKey(pieceCid, sp), pairBreakerThreshold, now)
+	b.fail(b.states.Providers, "SP", sp, providerBreakerThreshold, now)
+	b.state.changed()
+}
+
+// Records a piece retrieved and verified from a provider, closing all of the breakers involved
+func (b *breakerBoard) sourceSucceeded(pieceCid string, sp string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if sp != "" {
+		b.succeed(b.states.Pairs, "piece from SP", pairKey(pieceCid, sp))
+		b.succeed(b.states.Providers, "SP", sp)
+	}
+	b.succeed(b.states.Pieces, "piece", pieceCid)
+	delete(b.tried, pieceCid)
+	if _, found := b.states.Unretrievable[pieceCid]; found {
+		log.Infof("piece %s is retrievable again", pieceCid)
+		delete(b.states.Unretrievable, pieceCid)
+	}
+	b.state.changed()
+}
+
+// Records an attempt at a piece that ended without a deal. It only counts against the piece if a source
+// was actually tried, not when e.g. every source was busy. If the pair breakers for every one of its
+// sources are now open, the piece is marked as unretrievable
+func (b *breakerBoard) pieceFailed(pieceCid string, sources []Source) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.tried[pieceCid] {
+		return
+	}
+	delete(b.tried, pieceCid)
+
+	now := time.Now()
+	b.fail(b.states.Pieces, "piece", pieceCid, pieceBreakerThreshold, now)
+
+	if _, found := b.states.Unretrievable[pieceCid]; !found && len(sources) > 0 {
+		everySource := true
+		for _, source := range sources {
+			cb, found := b.states.Pairs[pairKey(pieceCid, source.ProviderID)]
+			if !found || cb.OpenUntil.IsZero() {
+				everySource = false
+				break
+			}
+		}
+		if everySource {
+			log.Infof("piece %s failed from all of its %d sources, marking it unretrievable", pieceCid, len(sources))
+			b.states.Unretrievable[pieceCid] = &unretrievablePiece{Since: now, NextProbe: now.Add(b.probeInterval)}
+		}
+	}
+	b.state.changed()
+}
+
+// One line per breaker level, counting the breakers that aren't closed. Open provider breakers are listed
+func (b *breakerBoard) summary() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	count := func(breakers map[string]*circuitBreaker) (int, int, []string) {
+		open, halfOpen := 0, 0
+		var keys []string
+		for key, cb := range breakers {
+			switch cb.state(now) {
+			case breakerOpen:
+				open++
+				keys = append(keys, fmt.Sprintf("%s for %v", key, cb.OpenUntil.Sub(now).Truncate(time.Minute)))
+			case breakerHalfOpen:
+				halfOpen++
+				keys = append(keys, key+" half-open")
+			}
+		}
+		sort.Strings(keys)
+		return open, halfOpen, keys
+	}
+
+	var lines []string
+	open, halfOpen, keys := count(b.states.Providers)
+	line := fmt.Sprintf("SP breakers: %d open, %d half-open", open, halfOpen)
+	if len(keys) > 0 {
+		line += " (" + strings.Join(keys, ", ") + ")"
+	}
+	lines = append(lines, line)
+
+	open, halfOpen, _ = count(b.states.Pieces)
+	lines = append(lines, fmt.Sprintf("piece breakers: %d open, %d half-open", open, halfOpen))
+	open, halfOpen, _ = count(b.states.Pairs)
+	lines = append(lines, fmt.Sprintf("piece from SP breakers: %d open, %d half-open", open, halfOpen))
+
+	nextProbe := time.Time{}
+	for _, u := range b.states.Unretrievable {
+		if nextProbe.IsZero() || u.NextProbe.Before(nextProbe) {
+			nextProbe = u.NextProbe
+		}
+	}
+	line = fmt.Sprintf("%d unretrievable pieces", len(b.states.Unretrievable))
+	if !nextProbe.IsZero() {
+		line += fmt.Sprintf(", next probe in %v", time.Until(nextProbe).Truncate(time.Minute))
+	}
+	return append(lines, line)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakerCooldownDoubles(t *testing.T) {
+	b := newBreakerBoard(10*time.Minute, time.Hour, 24*time.Hour)
+	now := time.Now()
+
+	b.fail(b.states.Providers, "SP", "f01", 2, now)
+	if state := b.states.Providers["f01"].state(now); state != breakerClosed {
+		t.Fatalf("expected the breaker to stay closed below the threshold, got %s", state)
+	}
+
+	expected := []time.Duration{10 * time.Minute, 20 * time.Minute, 40 * time.Minute, time.Hour, time.Hour}
+	for _, cooldown := range expected {
+		b.fail(b.states.Providers, "SP", "f01", 2, now)
+		if got := b.states.Providers["f01"].OpenUntil.Sub(now); got != cooldown {
+			t.Errorf("expected a cool-down of %v, got %v", cooldown, got)
+		}
+	}
+}
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+	b := newBreakerBoard(time.Minute, time.Hour, 24*time.Hour)
+	sources := []Source{{ProviderID: "f01"}}
+
+	for i := 0; i < providerBreakerThreshold; i++ {
+		b.sourceFailed("piece-a", "f01")
+	}
+	if b.pieceAllowed("piece-b", sources) {
+		t.Fatal("expected an open SP breaker to block its pieces")
+	}
+
+	// Let the cool-downs run out
+	b.states.Providers["f01"].OpenUntil = time.Now().Add(-time.Second)
+
+	if !b.pieceAllowed("piece-b", sources) {
+		t.Fatal("expected a half-open SP breaker to let a probe through")
+	}
+	if allowed := b.startPiece("piece-b", sources); len(allowed) != 1 {
+		t.Fatalf("expected the probe to be allowed, got %v", allowed)
+	}
+	if !b.pieceAllowed("piece-c", sources) {
+		t.Fatal("expected the probe not to be in flight until the source is tried")
+	}
+	if !b.startSource("piece-b", "f01") {
+		t.Fatal("expected the probe to be tried")
+	}
+	if b.startSource("piece-c", "f01") || b.pieceAllowed("piece-c", sources) {
+		t.Error("expected only one probe through a half-open breaker at a time")
+	}
+
+	b.sourceSucceeded("piece-b", "f01")
+	if _, found := b.states.Providers["f01"]; found {
+		t.Error("expected a successful probe to close the breaker")
+	}
+	if !b.pieceAllowed("piece-c", sources) {
+		t.Error("expected a closed breaker to let attempts through")
+	}
+}
+
+// Tries a piece from each of sps in turn, failing every time
+func failPiece(b *breakerBoard, pieceCid string, sources []Source, sps ...string) {
+	b.startPiece(pieceCid, sources)
+	for _, sp := range sps {
+		if b.startSource(pieceCid, sp) {
+			b.sourceFailed(pieceCid, sp)
+		}
+	}
+	b.pieceFailed(pieceCid, sources)
+}
+
+func TestBreakerUnretrievable(t *testing.T) {
+	b := newBreakerBoard(time.Minute, time.Hour, 24*time.Hour)
+	sources := []Source{{ProviderID: "f01"}, {ProviderID: "f02"}}
+
+	failPiece(b, "piece", sources, "f01", "f02")
+	failPiece(b, "piece", sources, "f01")
+	if _, found := b.states.Unretrievable["piece"]; found {
+		t.Fatal("expected a piece with a working source not to be unretrievable")
+	}
+
+	failPiece(b, "piece", sources, "f02")
+	u, found := b.states.Unretrievable["piece"]
+	if !found {
+		t.Fatal("expected a piece failing from every source to be unretrievable")
+	}
+	if b.pieceAllowed("piece", sources) {
+		t.Error("expected an unretrievable piece to wait for its probe")
+	}
+
+	// The probe is due, and goes to the sources whatever their pair breakers say
+	u.NextProbe = time.Now().Add(-time.Second)
+	if !b.pieceAllowed("piece", sources) {
+		t.Fatal("expected an unretrievable piece to be probed once due")
+	}
+	if allowed := b.startPiece("piece", sources); len(allowed) != 2 {
+		t.Errorf("expected the probe to try both sources, got %v", allowed)
+	}
+	if !b.startSource("piece", "f01") {
+		t.Fatal("expected the probe to ignore the open pair breaker")
+	}
+	if b.pieceAllowed("piece", sources) {
+		t.Error("expected the next probe to be a probe interval away")
+	}
+
+	b.sourceSucceeded("piece", "f02")
+	if _, found := b.states.Unretrievable["piece"]; found {
+		t.Error("expected a retrieved piece to no longer be unretrievable")
+	}
+}
+
+func TestBreakerOnlyCountsTriedSources(t *testing.T) {
+	b := newBreakerBoard(time.Minute, time.Hour, 24*time.Hour)
+	sources := []Source{{ProviderID: "f01"}, {ProviderID: "f02"}}
+
+	// Every source busy, e.g. at the concurrency limit for its SP
+	for i := 0; i < pieceBreakerThreshold; i++ {
+		b.startPiece("piece", sources)
+		b.pieceFailed("piece", sources)
+	}
+	if _, found := b.states.Pieces["piece"]; found {
+		t.Fatal("expected attempts without a source tried not to count against the piece")
+	}
+
+	// Half-open breakers for both SPs, only one of which is tried
+	for _, sp := range []string{"f01", "f02"} {
+		b.states.Providers[sp] = &circuitBreaker{Failures: providerBreakerThreshold, OpenUntil: time.Now().Add(-time.Second)}
+	}
+	b.startPiece("piece", sources)
+	b.startSource("piece", "f01")
+	if b.startSource("other", "f01") {
+		t.Error("expected the tried SP to be probing")
+	}
+	if !b.startSource("other", "f02") {
+		t.Error("expected the SP that wasn't tried to still let a probe through")
+	}
+
+	// A cancelled attempt lets the next probe through
+	b.sourceAbandoned("piece", "f01")
+	if !b.startSource("other", "f01") {
+		t.Error("expected an abandoned probe to let another one through")
+	}
+}
+
+func TestBreakersLoadPartialState(t *testing.T) {
+	var cfg EvergreenDealbotConfig
+	cfg.Common.StateLocation = t.TempDir()
+	cfg.Evergreen.BreakerCooldown = 10
+	cfg.Evergreen.BreakerMaxCooldown = 48
+	cfg.Evergreen.UnretrievableProbeInterval = 24
+
+	// Saved while f01 was open, by a version without the other breaker levels
+	saved := map[string]interface{}{
+		"providers": map[string]*circuitBreaker{
+			"f01": {Failures: providerBreakerThreshold, OpenUntil: time.Now().Add(time.Hour)},
+		},
+	}
+	if err := SaveJSON(filepath.Join(cfg.Common.StateLocation, "breakers.json"), saved); err != nil {
+		t.Fatal(err)
+	}
+
+	sourceBreakers = newBreakerBoard(0, 0, 0)
+	if err := InitBreakers(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if sourceBreakers.pieceAllowed("piece", []Source{{ProviderID: "f01"}}) {
+		t.Error("expected the SP breaker to still be open")
+	}
+
+	// The missing levels work too
+	for i := 0; i < pairBreakerThreshold; i++ {
+		failPiece(sourceBreakers, "piece", []Source{{ProviderID: "f02"}}, "f02")
+	}
+	if lines := sourceBreakers.summary(); len(lines) != 4 || !strings.HasPrefix(lines[0], "SP breakers: 1 open") || !strings.HasPrefix(lines[3], "1 unretrievable") {
+		t.Errorf("unexpected summary %v", lines)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+)
+
+// Returned (wrapped) when a CAR is malformed, rather than unreadable
+var errInvalidCar = errors.New("invalid CAR")
+
+// Checks that a CAR's only root is payloadCid and that every block's data matches its multihash
+// If paddedSize isn't 0, the CAR must also fit in a piece of that size
+// A zero length section ends the CAR, as anything after it is piece padding
+func ValidateCar(path string, payloadCid string, paddedSize int64) error {
+	expectedRoot, err := cid.Parse(payloadCid)
+	if err != nil {
+		return fmt.Errorf("parsing payload cid: %s", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if paddedSize > 0 {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() > int64(abi.PaddedPieceSize(paddedSize).Unpadded()) {
+			return fmt.Errorf("%w: %d bytes is too big for a %d byte piece", errInvalidCar, info.Size(), paddedSize)
+		}
+	}
+
+	br := bufio.NewReaderSize(f, 1<<20)
+	header, err := car.ReadHeader(br)
+	if err != nil {
+		return fmt.Errorf("%w: reading header: %s", errInvalidCar, err)
+	}
+	if header.Version != 1 {
+		return fmt.Errorf("%w: unsupported version %d", errInvalidCar, header.Version)
+	}
+	if len(header.Roots) != 1 || !header.Roots[0].Equals(expectedRoot) {
+		return fmt.Errorf("%w: roots %v don't match payload cid %s", errInvalidCar, header.Roots, payloadCid)
+	}
+
+	blocks := 0
+	for {
+		section, err := util.LdRead(br)
+		if err == io.EOF || (err == nil && len(section) == 0) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: reading block %d: %s", errInvalidCar, blocks, err)
+		}
+
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			return fmt.Errorf("%w: block %d has a bad cid: %s", errInvalidCar, blocks, err)
+		}
+		hashed, err := c.Prefix().Sum(section[n:])
+		if err != nil {
+			return fmt.Errorf("%w: hashing block %s: %s", errInvalidCar, c, err)
+		}
+		if !hashed.Equals(c) {
+			return fmt.Errorf("%w: block %s hashes to %s", errInvalidCar, c, hashed)
+		}
+		blocks++
+	}
+
+	if blocks == 0 {
+		return fmt.Errorf("%w: no blocks", errInvalidCar)
+	}
+	return nil
+}
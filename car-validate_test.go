@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+	"github.com/multiformats/go-multihash"
+)
+
+// Builds a CAR of raw blocks, rooted at the first one
+func testCar(t *testing.T, blocks ...[]byte) ([]byte, cid.Cid) {
+	prefix := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}
+
+	var cids []cid.Cid
+	for _, b := range blocks {
+		c, err := prefix.Sum(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cids = append(cids, c)
+	}
+
+	var buf bytes.Buffer
+	if err := car.WriteHeader(&car.CarHeader{Roots: cids[:1], Version: 1}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range blocks {
+		if err := util.LdWrite(&buf, cids[i].Bytes(), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes(), cids[0]
+}
+
+func writeTestCar(t *testing.T, data []byte) string {
+	path := filepath.Join(t.TempDir(), "test.car")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateCar(t *testing.T) {
+	data, root := testCar(t, []byte("root block"), []byte("second block"))
+
+	if err := ValidateCar(writeTestCar(t, data), root.String(), 0); err != nil {
+		t.Errorf("expected a valid CAR, got %s", err)
+	}
+
+	// Piece padding after the CAR is ignored
+	padded := append(append([]byte{}, data...), make([]byte, 64)...)
+	if err := ValidateCar(writeTestCar(t, padded), root.String(), 256); err != nil {
+		t.Errorf("expected a zero padded CAR to be valid, got %s", err)
+	}
+}
+
+func TestValidateCarErrors(t *testing.T) {
+	data, root := testCar(t, []byte("root block"), []byte("second block"))
+	_, otherRoot := testCar(t, []byte("another root"))
+
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	tests := []struct {
+		name       string
+		data       []byte
+		root       cid.Cid
+		paddedSize int64
+	}{
+		{"wrong root", data, otherRoot, 0},
+		{"corrupted block", corrupted, root, 0},
+		{"truncated", data[:len(data)-3], root, 0},
+		{"too big for the piece", data, root, 64},
+		{"not a CAR", []byte("hello"), root, 0},
+	}
+
+	for _, tt := range tests {
+		err := ValidateCar(writeTestCar(t, tt.data), tt.root.String(), tt.paddedSize)
+		if !errors.Is(err, errInvalidCar) {
+			t.Errorf("%s: expected an invalid CAR error, got %v", tt.name, err)
+		}
+	}
+
+	if err := ValidateCar(filepath.Join(t.TempDir(), "missing.car"), root.String(), 0); err == nil || errors.Is(err, errInvalidCar) {
+		t.Errorf("expected a missing file to be a read error, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Immutable view of the Evergreen available deals list, swapped in whole by the refresher
+type catalogSnapshot struct {
+	deals      []EvergreenDeal
+	stateEpoch int64
+}
+
+// Available deals cache, refreshed in the background so readers never wait on the Evergreen API
+type dealCatalog struct {
+	snapshot  atomic.Value // *catalogSnapshot
+	fetchedAt atomic.Value // time.Time of the last successful fetch, even if it didn't change the snapshot
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// Replica counts learned from RequestDeal responses, kept across snapshot swaps
+	replicasMu      sync.RWMutex
+	replicas        map[string]replicaCount
+	replicasVersion int // Changes whenever replicas does
+
+	// Ranking of a snapshot with a version of the replica counts, see PrioritisedDeals
+	rankedMu      sync.Mutex
+	ranked        []EvergreenDeal
+	rankedFor     *catalogSnapshot
+	rankedVersion int
+}
+
+var dealList = &dealCatalog{ready: make(chan struct{}), replicas: make(map[string]replicaCount)}
+
+// Returns the current available deals list, waiting for the first refresh to complete if needed
+// The returned slice is shared between all readers and must not be modified
+func (c *dealCatalog) Deals() []EvergreenDeal {
+	<-c.ready
+	return c.current().deals
+}
+
+func (c *dealCatalog) current() *catalogSnapshot {
+	s, _ := c.snapshot.Load().(*catalogSnapshot)
+	return s
+}
+
+// How long ago the available deals were last downloaded from Evergreen
+func (c *dealCatalog) Age() time.Duration {
+	fetchedAt, ok := c.fetchedAt.Load().(time.Time)
+	if !ok {
+		return 0
+	}
+	return time.Since(fetchedAt)
+}
+
+// Chain epoch the current snapshot was generated at by Evergreen
+func (c *dealCatalog) StateEpoch() int64 {
+	s := c.current()
+	if s == nil {
+		return 0
+	}
+	return s.stateEpoch
+}
+
+func (c *dealCatalog) swap(s *catalogSnapshot) {
+	c.snapshot.Store(s)
+	c.readyOnce.Do(func() { close(c.ready) })
+
+	// Forget replica counts for pieces that are no longer available
+	inSnapshot := make(map[string]bool, len(s.deals))
+	for _, d := range s.deals {
+		inSnapshot[d.PieceCid] = true
+	}
+
+	c.replicasMu.Lock()
+	for pieceCid := range c.replicas {
+		if !inSnapshot[pieceCid] {
+			delete(c.replicas, pieceCid)
+			c.replicasVersion++
+		}
+	}
+	c.replicasMu.Unlock()
+}
+
+// Records the tentative replica counts Evergreen returned when requesting a piece
+func (c *dealCatalog) learnReplicas(pieceCid string, counts map[string]int64) {
+	if len(counts) == 0 {
+		return
+	}
+
+	c.replicasMu.Lock()
+	if c.replicas == nil {
+		c.replicas = make(map[string]replicaCount)
+	}
+	c.replicas[pieceCid] = replicaCount{counts: counts, learnedAt: time.Now()}
+	c.replicasVersion++
+	c.replicasMu.Unlock()
+}
+
+// Returns the available deals, ordered by prioritiseDeals
+// The ranking is only redone when the snapshot or the replica counts change, so every thread shares it
+// The returned slice must not be modified
+func (c *dealCatalog) PrioritisedDeals() []EvergreenDeal {
+	<-c.ready
+	snapshot := c.current()
+
+	c.replicasMu.RLock()
+	defer c.replicasMu.RUnlock()
+	c.rankedMu.Lock()
+	defer c.rankedMu.Unlock()
+
+	if c.rankedFor != snapshot || c.rankedVersion != c.replicasVersion {
+		c.ranked = prioritiseDeals(snapshot.deals, c.replicas)
+		c.rankedFor = snapshot
+		c.rankedVersion = c.replicasVersion
+	}
+	return c.ranked
+}
+
+// Periodically refreshes the available deals list, serving the previous snapshot while a refresh is in flight
+func CatalogRefresherThread(ec EvergreenClient, cfg EvergreenDealbotConfig) {
+	interval := time.Duration(cfg.Evergreen.DealRequeryInterval) * time.Minute
+
+	for {
+		err := refreshCatalog(ec, cfg)
+		if err != nil {
+			log.Errorf("Unable to retrieve Available Deals list, serving snapshot from %v ago. %s", dealList.Age().Truncate(time.Second), err)
+
+			// Retry sooner while the list is stale
+			if interval > time.Minute {
+				time.Sleep(time.Minute)
+				continue
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func refreshCatalog(ec EvergreenClient, cfg EvergreenDealbotConfig) error {
+	spid, err := MinerActorAddress(cfg.Lotus.MinerApiInfo)
+	if err != nil {
+		return err
+	}
+
+	newDeals, err := ec.QueryAvailableDeals(spid, eligibleDealFilter(cfg))
+	if err != nil {
+		return err
+	}
+
+	if !dealList.update(newDeals) {
+		log.Debugf("available deals list unchanged since epoch %d", dealList.StateEpoch())
+		return nil
+	}
+
+	log.Debugf("found %d open deals at epoch %d", len(newDeals.Response), newDeals.ResponseStateEpoch)
+	return nil
+}
+
+// Swaps in a new snapshot, unless Evergreen's state epoch hasn't advanced since the current one
+// Either way the current snapshot is up to date as of now. Returns true if the snapshot was swapped
+func (c *dealCatalog) update(newDeals *AvailableDeals) bool {
+	defer c.fetchedAt.Store(time.Now())
+
+	current := c.current()
+	if current != nil && newDeals.ResponseStateEpoch != 0 && newDeals.ResponseStateEpoch <= current.stateEpoch {
+		return false
+	}
+
+	c.swap(&catalogSnapshot{
+		deals:      newDeals.Response,
+		stateEpoch: newDeals.ResponseStateEpoch,
+	})
+	return true
+}
+
+// Only keep pieces we could ever take, so the cached deal list stays small
+func eligibleDealFilter(cfg EvergreenDealbotConfig) DealFilter {
+	return func(d *EvergreenDeal) bool {
+		// Deals that are too small are rejected by Boost
+		return d.PaddedPieceSize >= cfg.Lotus.MinPieceSize && len(d.Sources) > 0
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDealCatalogSkipsStaleEpochs(t *testing.T) {
+	c := &dealCatalog{ready: make(chan struct{})}
+
+	if !c.update(&AvailableDeals{ResponseStateEpoch: 100, Response: []EvergreenDeal{{PieceCid: "a"}}}) {
+		t.Fatal("first snapshot should always be swapped in")
+	}
+
+	c.fetchedAt.Store(time.Now().Add(-time.Hour))
+	if c.update(&AvailableDeals{ResponseStateEpoch: 100, Response: []EvergreenDeal{{PieceCid: "b"}}}) {
+		t.Error("snapshot from the same epoch should be skipped")
+	}
+	if age := c.Age(); age > time.Minute {
+		t.Errorf("expected a skipped refresh to count as a fetch, got age %v", age)
+	}
+
+	if deals := c.Deals(); len(deals) != 1 || deals[0].PieceCid != "a" {
+		t.Errorf("unexpected deals %+v", deals)
+	}
+
+	if !c.update(&AvailableDeals{ResponseStateEpoch: 101, Response: []EvergreenDeal{{PieceCid: "c"}}}) {
+		t.Error("snapshot from a newer epoch should be swapped in")
+	}
+
+	if deals := c.Deals(); len(deals) != 1 || deals[0].PieceCid != "c" || c.StateEpoch() != 101 {
+		t.Errorf("unexpected deals %+v at epoch %d", deals, c.StateEpoch())
+	}
+}
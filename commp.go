@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/filecoin-project/go-commp-utils/ffiwrapper"
+	"github.com/filecoin-project/go-commp-utils/writer"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reasons a CAR can be rejected
+const (
+	failureCommPMismatch = "commp mismatch"
+	failureInvalidCar    = "invalid car"
+)
+
+// Computes the piece commitment of a CAR, zero padded up to paddedSize like it will be in the sector
+func CarPieceCid(path string, paddedSize int64) (cid.Cid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer f.Close()
+
+	w := &writer.Writer{}
+	if _, err := io.CopyBuffer(w, f, make([]byte, writer.CommPBuf)); err != nil {
+		return cid.Undef, fmt.Errorf("reading %s: %s", path, err)
+	}
+
+	sum, err := w.Sum()
+	if err != nil {
+		return cid.Undef, fmt.Errorf("computing commp of %s: %s", path, err)
+	}
+
+	target := abi.PaddedPieceSize(paddedSize)
+	if sum.PieceSize > target {
+		return cid.Undef, fmt.Errorf("%s is too big for a %d byte piece", path, paddedSize)
+	}
+	if sum.PieceSize == target {
+		return sum.PieceCID, nil
+	}
+
+	return ffiwrapper.ZeroPadPieceCommitment(sum.PieceCID, sum.PieceSize.Unpadded(), target.Unpadded())
+}
+
+// Runs the structural checks on a CAR, then the piece commitment check, before a deal is requested for it
+// Bad CARs are quarantined under the name of sourceSp ("" for local CARs). Recording the failure is left
+// to the caller. CARs that passed before and haven't changed since aren't checked again
+func VerifyCar(path string, pieceCid string, payloadCid string, paddedSize int64, sourceSp string, cfg EvergreenDealbotConfig) error {
+	// Taken before verifying, so a CAR changed while it is hashed is checked again next time
+	info, statErr := os.Stat(path)
+	if statErr == nil && carAlreadyVerified(path, info, pieceCid, payloadCid, paddedSize) {
+		return nil
+	}
+
+	if err := ValidateCar(path, payloadCid, paddedSize); err != nil {
+		if errors.Is(err, errInvalidCar) {
+			rejectCar(path, pieceCid, sourceSp, failureInvalidCar, cfg)
+		}
+		return fmt.Errorf("CAR for %s: %s", pieceCid, err)
+	}
+
+	if err := VerifyCarPieceCid(path, pieceCid, paddedSize, sourceSp, cfg); err != nil {
+		return err
+	}
+	if statErr == nil {
+		rememberVerifiedCar(path, info, pieceCid, payloadCid, paddedSize)
+	}
+	return nil
+}
+
+// Checks that the CAR at path hashes to pieceCid before a deal is requested for it
+// If it doesn't, the CAR is quarantined under the name of sourceSp ("" for local CARs)
+func VerifyCarPieceCid(path string, pieceCid string, paddedSize int64, sourceSp string, cfg EvergreenDealbotConfig) error {
+	expected, err := cid.Parse(pieceCid)
+	if err != nil {
+		return fmt.Errorf("parsing piece cid: %s", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > int64(abi.PaddedPieceSize(paddedSize).Unpadded()) {
+		rejectCar(path, pieceCid, sourceSp, failureCommPMismatch, cfg)
+		return fmt.Errorf("CAR for %s is %d bytes, too big for the piece", pieceCid, info.Size())
+	}
+
+	actual, err := CarPieceCid(path, paddedSize)
+	if err != nil {
+		return err
+	}
+	if !actual.Equals(expected) {
+		rejectCar(path, pieceCid, sourceSp, failureCommPMismatch, cfg)
+		return fmt.Errorf("CAR for %s has piece cid %s", pieceCid, actual)
+	}
+	return nil
+}
+
+// Moves a bad CAR out of the way so it's never imported. The SP that served it is only used to name it
+func rejectCar(path string, pieceCid string, sourceSp string, reason string, cfg EvergreenDealbotConfig) {
+	source := sourceSp
+	if source == "" {
+		source = "local"
+	}
+	log.Errorf("rejecting CAR for %s from %s: %s", pieceCid, source, reason)
+
+	if err := os.MkdirAll(cfg.Common.CarLocationQuarantine, 0755); err != nil {
+		log.Errorf("creating quarantine directory: %s", err)
+		os.Remove(path)
+		return
+	}
+
+	quarantined := filepath.Join(cfg.Common.CarLocationQuarantine, fmt.Sprintf("%s.%s.car", pieceCid, source))
+	if err := os.Rename(path, quarantined); err != nil {
+		// May be on another filesystem
+		if err := MoveFile(path, quarantined); err != nil {
+			log.Errorf("quarantining %s: %s", path, err)
+			os.Remove(path)
+		}
+	}
+}
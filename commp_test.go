@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/go-commp-utils/writer"
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+// Piece CID of data zero padded to the full piece, computed without padding the commitment itself
+func carPieceCid(t *testing.T, data []byte, paddedSize int64) string {
+	padded := make([]byte, abi.PaddedPieceSize(paddedSize).Unpadded())
+	copy(padded, data)
+
+	w := &writer.Writer{}
+	if _, err := w.Write(padded); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := w.Sum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.PieceSize != abi.PaddedPieceSize(paddedSize) {
+		t.Fatalf("expected a %d byte piece, got %d", paddedSize, sum.PieceSize)
+	}
+	return sum.PieceCID.String()
+}
+
+func commpTestConfig(t *testing.T) EvergreenDealbotConfig {
+	var cfg EvergreenDealbotConfig
+	cfg.Common.CarLocationQuarantine = filepath.Join(t.TempDir(), "quarantine")
+	return cfg
+}
+
+func TestVerifyCarPieceCidPadded(t *testing.T) {
+	data, _ := testCar(t, []byte("root block"), []byte("second block"))
+	path := writeTestCar(t, data)
+	pieceCid := carPieceCid(t, data, 4096)
+
+	if err := VerifyCarPieceCid(path, pieceCid, 4096, "f01", commpTestConfig(t)); err != nil {
+		t.Errorf("expected the CAR to match its padded piece, got %s", err)
+	}
+	if !FileExists(path) {
+		t.Error("expected a matching CAR to be left in place")
+	}
+}
+
+func TestVerifyCarPieceCidMismatch(t *testing.T) {
+	data, _ := testCar(t, []byte("root block"), []byte("second block"))
+	other, _ := testCar(t, []byte("another root"), []byte("another block"))
+	path := writeTestCar(t, data)
+	pieceCid := carPieceCid(t, other, 256)
+	cfg := commpTestConfig(t)
+
+	if err := VerifyCarPieceCid(path, pieceCid, 256, "f01", cfg); err == nil {
+		t.Fatal("expected a CAR with another piece cid to fail verification")
+	}
+	if FileExists(path) {
+		t.Error("expected the mismatching CAR to be moved away")
+	}
+
+	quarantined, err := ioutil.ReadFile(filepath.Join(cfg.Common.CarLocationQuarantine, pieceCid+".f01.car"))
+	if err != nil {
+		t.Fatalf("expected the CAR to be quarantined: %s", err)
+	}
+	if !bytes.Equal(quarantined, data) {
+		t.Error("expected the quarantined CAR to be unchanged")
+	}
+}
+
+func TestVerifyCarPieceCidTooBig(t *testing.T) {
+	data, _ := testCar(t, bytes.Repeat([]byte("block"), 100))
+	path := writeTestCar(t, data)
+	cfg := commpTestConfig(t)
+
+	// The piece cid isn't even computed, as no CAR this size fits in a 256 byte piece
+	pieceCid := carPieceCid(t, nil, 256)
+	if err := VerifyCarPieceCid(path, pieceCid, 256, "", cfg); err == nil {
+		t.Fatal("expected a CAR too big for its piece to fail verification")
+	}
+	if !FileExists(filepath.Join(cfg.Common.CarLocationQuarantine, pieceCid+".local.car")) {
+		t.Error("expected the CAR to be quarantined")
+	}
+}
@@ -9,26 +9,61 @@ import (
 
 type EvergreenDealbotConfig struct {
 	Lotus struct {
-		FullNodeApiInfo   string `env:"FULLNODE_API_INFO,notEmpty"`
-		MinerApiInfo      string `env:"MINER_API_INFO,notEmpty"`
-		BoostUrl          string `env:"BOOST_URL,notEmpty"`
-		BoostAuthToken    string `env:"BOOST_AUTH_TOKEN,notEmpty"`
-		MaxRetrievalPrice string `env:"MAX_RETRIEVAL_PRICE" envDefault:"0"`
-		RetrievalTimeout  uint   `env:"RETRIEVAL_TIMEOUT_MINUTES" envDefault:"10"`
-		MinPieceSize      int64  `env:"MIN_PIECE_SIZE" envDefault:"1073741824"`
+		FullNodeApiInfo          string  `env:"FULLNODE_API_INFO,notEmpty"`
+		MinerApiInfo             string  `env:"MINER_API_INFO,notEmpty"`
+		WalletApiInfo            string  `env:"WALLET_API_INFO"`
+		BoostUrl                 string  `env:"BOOST_URL,notEmpty"`
+		BoostAuthToken           string  `env:"BOOST_AUTH_TOKEN,notEmpty"`
+		MaxRetrievalPrice        string  `env:"MAX_RETRIEVAL_PRICE" envDefault:"0"`
+		MaxRetrievalCostPerGiB   string  `env:"MAX_RETRIEVAL_COST_PER_GIB"`
+		RetrievalDailyBudget     string  `env:"RETRIEVAL_DAILY_BUDGET_FIL"`
+		RetrievalMonthlyBudget   string  `env:"RETRIEVAL_MONTHLY_BUDGET_FIL"`
+		RetrievalSpDailyBudget   string  `env:"RETRIEVAL_SP_DAILY_BUDGET_FIL"`
+		RetrievalSpMonthlyBudget string  `env:"RETRIEVAL_SP_MONTHLY_BUDGET_FIL"`
+		RetrievalTimeout         uint    `env:"RETRIEVAL_TIMEOUT_MINUTES" envDefault:"10"`
+		TransferStallTimeout     uint    `env:"TRANSFER_STALL_TIMEOUT_MINUTES" envDefault:"30"`
+		SealingEstimate          uint    `env:"SEALING_ESTIMATE_HOURS" envDefault:"12"`
+		RetrievalBackends        string  `env:"RETRIEVAL_BACKENDS" envDefault:"*=http,graphsync"`
+		RetrievalRaceSources     uint    `env:"RETRIEVAL_RACE_SOURCES" envDefault:"1"`
+		ReputationHalfLife       uint    `env:"REPUTATION_HALF_LIFE_HOURS" envDefault:"72"`
+		ReputationMinSuccessRate float64 `env:"REPUTATION_MIN_SUCCESS_RATE" envDefault:"0.2"`
+		MinPieceSize             int64   `env:"MIN_PIECE_SIZE" envDefault:"1073741824"`
 	}
 
 	Evergreen struct {
-		DealRequeryInterval          uint `env:"AVAILABLE_DEAL_QUERY_INTERVAL_MINUTES" envDefault:"2"`
-		MaxConcurrentRetrievalsPerSp uint `env:"MAX_CONCURRENT_RETRIEVALS_PER_SP" envDefault:"2"`
+		ApiUrl                       string  `env:"EVERGREEN_API_URL" envDefault:"https://api.evergreen.filecoin.io"`
+		ApiTimeout                   uint    `env:"EVERGREEN_API_TIMEOUT_SECONDS" envDefault:"300"`
+		ApiConnectTimeout            uint    `env:"EVERGREEN_API_CONNECT_TIMEOUT_SECONDS" envDefault:"30"`
+		ApiMaxRetries                uint    `env:"EVERGREEN_API_MAX_RETRIES" envDefault:"5"`
+		UserAgent                    string  `env:"EVERGREEN_USER_AGENT" envDefault:"evergreen-dealbot"`
+		FilSPIDSigner                string  `env:"FIL_SPID_SIGNER" envDefault:"lotus"`
+		FilSPIDKeyFile               string  `env:"FIL_SPID_KEY_FILE"`
+		FilSPIDBeaconUrl             string  `env:"FIL_SPID_BEACON_URL"`
+		FilSPIDBeaconChain           string  `env:"FIL_SPID_BEACON_CHAIN"`
+		AuthCacheEpochs              uint    `env:"FIL_SPID_CACHE_EPOCHS" envDefault:"10"`
+		AuthRefreshAheadEpochs       uint    `env:"FIL_SPID_REFRESH_AHEAD_EPOCHS" envDefault:"2"`
+		DealRequeryInterval          uint    `env:"AVAILABLE_DEAL_QUERY_INTERVAL_MINUTES" envDefault:"2"`
+		TenantAllow                  []int64 `env:"TENANT_ALLOW" envSeparator:","`
+		TenantDeny                   []int64 `env:"TENANT_DENY" envSeparator:","`
+		TenantDailyQuota             string  `env:"TENANT_DAILY_QUOTA_BYTES"`
+		TenantTotalQuota             string  `env:"TENANT_TOTAL_QUOTA_BYTES"`
+		MaxConcurrentRetrievalsPerSp uint    `env:"MAX_CONCURRENT_RETRIEVALS_PER_SP" envDefault:"2"`
+		BreakerCooldown              uint    `env:"BREAKER_COOLDOWN_MINUTES" envDefault:"10"`
+		BreakerMaxCooldown           uint    `env:"BREAKER_MAX_COOLDOWN_HOURS" envDefault:"48"`
+		UnretrievableProbeInterval   uint    `env:"UNRETRIEVABLE_PROBE_HOURS" envDefault:"24"`
 	}
 
 	Common struct {
-		MaxThreads          uint   `env:"MAX_THREADS" envDefault:"4"`
-		CarLocationLongterm string `env:"CAR_LOCATION_LONGTERM" envDefault:"/tmp"`
-		CarLocationDownload string `env:"CAR_LOCATION_DOWNLOAD" envDefault:"/tmp"`
-		LogDebug            bool   `env:"DEBUG" envDefault:"false"`
-		LogFileLocation     string `env:"LOG_FILE_LOCATION" envDefault:""`
+		MaxThreads            uint   `env:"MAX_THREADS" envDefault:"4"`
+		CarLocationLongterm   string `env:"CAR_LOCATION_LONGTERM" envDefault:"/tmp"`
+		CarLocationDownload   string `env:"CAR_LOCATION_DOWNLOAD" envDefault:"/tmp"`
+		CarLocationQuarantine string `env:"CAR_LOCATION_QUARANTINE" envDefault:"/tmp/quarantine"`
+		PartialMaxAge         uint   `env:"PARTIAL_DOWNLOAD_MAX_AGE_HOURS" envDefault:"24"`
+		JanitorInterval       uint   `env:"JANITOR_INTERVAL_MINUTES" envDefault:"15"`
+		StateLocation         string `env:"STATE_LOCATION" envDefault:"/tmp/evergreen-dealbot"`
+		LogDebug              bool   `env:"DEBUG" envDefault:"false"`
+		LogFileLocation       string `env:"LOG_FILE_LOCATION" envDefault:""`
+		StatusInterval        uint   `env:"STATUS_INTERVAL_MINUTES" envDefault:"10"`
 	}
 }
 
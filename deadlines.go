@@ -0,0 +1,272 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Weight of the newest sample in the timing moving averages
+const timingSmoothing = 0.2
+
+// Moving averages of retrieval throughput, proposal lead times and sealing times
+type timingHistory struct {
+	RetrievalBytesPerSecond float64 `json:"retrieval_bytes_per_second"`
+	RetrievalSamples        int64   `json:"retrieval_samples"`
+	ProposalLeadSeconds     float64 `json:"proposal_lead_seconds"`
+	ProposalSamples         int64   `json:"proposal_samples"`
+	SealingSeconds          float64 `json:"sealing_seconds"`
+	SealingSamples          int64   `json:"sealing_samples"`
+}
+
+// Keeps track of when deals have to be sealed by, so no time is spent on pieces that would miss their start epoch
+// Deadlines come from the pending proposals seen on Evergreen. For pieces that haven't been requested yet,
+// the deadline shown in the status is estimated from how far out previous proposals started. The timing
+// history is saved, so estimates are available straight after a restart
+// Proposals stay pending until their deal is on chain, so the ones already imported are remembered until
+// then, even across restarts, to keep them from being retrieved and imported again. How long that takes is
+// how long the SP took to seal the piece, which replaces the configured sealing estimate once known
+type deadlineTracker struct {
+	mu sync.Mutex
+
+	proposals     map[string]PendingProposal
+	fetchedAt     time.Time // When the pending proposals were listed, which their hours remaining count from
+	history       timingHistory
+	state         *persistedState
+	imported      map[string]time.Time // When each proposal was imported, by proposal CID
+	importedState *persistedState
+
+	sealingEstimate time.Duration // Used until a sealing time has been recorded
+}
+
+var dealDeadlines = newDeadlineTracker()
+
+func newDeadlineTracker() *deadlineTracker {
+	d := &deadlineTracker{proposals: make(map[string]PendingProposal), imported: make(map[string]time.Time)}
+	d.state = newPersistedState("timings.json", &d.mu, &d.history, stateSaveDelay)
+	d.importedState = newPersistedState("imported-proposals.json", &d.mu, &d.imported, 0)
+	return d
+}
+
+// Loads the sealing estimate from config, and the timing history and imported proposals from the state directory
+func InitDealDeadlines(cfg EvergreenDealbotConfig) error {
+	d := dealDeadlines
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.sealingEstimate = time.Duration(cfg.Lotus.SealingEstimate) * time.Hour
+	if err := d.state.load(cfg.Common.StateLocation); err != nil {
+		return err
+	}
+	return d.importedState.load(cfg.Common.StateLocation)
+}
+
+// Replaces the known pending proposals with the latest list from Evergreen
+// Imported proposals that are no longer pending have made it on chain or expired, and are forgotten
+// The ones that went before their start epoch were sealed, and the time since their import is recorded
+func (d *deadlineTracker) updateProposals(proposals []PendingProposal) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	previous := make(map[string]PendingProposal, len(d.proposals))
+	for _, p := range d.proposals {
+		previous[p.DealProposalCid] = p
+	}
+
+	now := time.Now()
+	d.fetchedAt = now
+	d.proposals = make(map[string]PendingProposal, len(proposals))
+	pending := make(map[string]bool, len(proposals))
+	for _, p := range proposals {
+		d.proposals[p.PieceCid] = p
+		pending[p.DealProposalCid] = true
+	}
+
+	forgotten := false
+	for proposalCid, importedAt := range d.imported {
+		if pending[proposalCid] {
+			continue
+		}
+		if p, found := previous[proposalCid]; found && now.Before(filEpochTime(p.DealStartEpoch)) {
+			d.recordSealing(now.Sub(importedAt))
+		}
+		delete(d.imported, proposalCid)
+		forgotten = true
+	}
+	if forgotten {
+		d.importedState.changed()
+	}
+}
+
+// Records how long an imported proposal took to be sealed. The lock must be held
+func (d *deadlineTracker) recordSealing(took time.Duration) {
+	if took <= 0 {
+		return
+	}
+	d.history.SealingSeconds = smoothTiming(d.history.SealingSeconds, took.Seconds(), d.history.SealingSamples)
+	d.history.SealingSamples++
+	d.state.changed()
+}
+
+// Records that the data for a proposal has been handed to Boost
+func (d *deadlineTracker) recordImport(p PendingProposal) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.imported[p.DealProposalCid] = time.Now()
+	d.importedState.changed()
+}
+
+// Whether the pending proposal for a piece has already been imported
+func (d *deadlineTracker) alreadyImported(pieceCid string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, found := d.proposals[pieceCid]
+	if !found {
+		return false
+	}
+	_, imported := d.imported[p.DealProposalCid]
+	return imported
+}
+
+// Returns the pending proposal for a piece, if Evergreen has one for us
+func (d *deadlineTracker) proposal(pieceCid string) (PendingProposal, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, found := d.proposals[pieceCid]
+	return p, found
+}
+
+// Pieces we already hold proposals for and haven't imported yet, the ones due soonest first
+// A proposal is due by its start epoch, or by when it expires if that comes first
+func (d *deadlineTracker) urgentDeals() []EvergreenDeal {
+	d.mu.Lock()
+	proposals := make([]PendingProposal, 0, len(d.proposals))
+	due := make(map[string]time.Time, len(d.proposals))
+	for _, p := range d.proposals {
+		if _, imported := d.imported[p.DealProposalCid]; !imported {
+			proposals = append(proposals, p)
+			due[p.PieceCid] = d.dueBy(p)
+		}
+	}
+	d.mu.Unlock()
+
+	sort.Slice(proposals, func(i, j int) bool {
+		return due[proposals[i].PieceCid].Before(due[proposals[j].PieceCid])
+	})
+
+	deals := make([]EvergreenDeal, 0, len(proposals))
+	for _, p := range proposals {
+		deals = append(deals, EvergreenDeal{
+			PieceCid:        p.PieceCid,
+			Tenants:         []int64{p.TenantID},
+			PaddedPieceSize: p.PieceSize,
+			Sources:         p.Sources,
+		})
+	}
+	return deals
+}
+
+// The nearer of a proposal's start time and its expiry. The lock must be held
+func (d *deadlineTracker) dueBy(p PendingProposal) time.Time {
+	due := filEpochTime(p.DealStartEpoch)
+	if p.HoursRemaining > 0 {
+		if expires := d.fetchedAt.Add(time.Duration(p.HoursRemaining) * time.Hour); expires.Before(due) {
+			due = expires
+		}
+	}
+	return due
+}
+
+// Records how long a retrieval took
+func (d *deadlineTracker) recordRetrieval(bytes int64, took time.Duration) {
+	if bytes <= 0 || took <= 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rate := float64(bytes) / took.Seconds()
+	d.history.RetrievalBytesPerSecond = smoothTiming(d.history.RetrievalBytesPerSecond, rate, d.history.RetrievalSamples)
+	d.history.RetrievalSamples++
+	d.state.changed()
+}
+
+// Records how far out a proposal starts, compared to when the deal was requested
+func (d *deadlineTracker) recordProposal(p PendingProposal, requestedAt time.Time) {
+	lead := filEpochTime(p.DealStartEpoch).Sub(requestedAt)
+	if lead <= 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.history.ProposalLeadSeconds = smoothTiming(d.history.ProposalLeadSeconds, lead.Seconds(), d.history.ProposalSamples)
+	d.history.ProposalSamples++
+	d.state.changed()
+}
+
+func smoothTiming(average float64, sample float64, samples int64) float64 {
+	if samples == 0 {
+		return sample
+	}
+	return average*(1-timingSmoothing) + sample*timingSmoothing
+}
+
+// Expected retrieval time for a piece, or 0 if no retrieval has completed yet
+func (d *deadlineTracker) estimateRetrieval(size int64) time.Duration {
+	if d.history.RetrievalSamples == 0 || d.history.RetrievalBytesPerSecond <= 0 {
+		return 0
+	}
+	return time.Duration(float64(size) / d.history.RetrievalBytesPerSecond * float64(time.Second))
+}
+
+// Expected time for the SP to seal a piece, learned from earlier imports or else the configured estimate
+func (d *deadlineTracker) estimateSealing() time.Duration {
+	if d.history.SealingSamples == 0 || d.history.SealingSeconds <= 0 {
+		return d.sealingEstimate
+	}
+	return time.Duration(d.history.SealingSeconds * float64(time.Second))
+}
+
+// Returns the time a piece's deal starts, and whether it is only an estimate
+// Returns a zero time if there is no proposal for the piece and no history to estimate from
+func (d *deadlineTracker) Deadline(pieceCid string, size int64) (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if p, found := d.proposals[pieceCid]; found {
+		return filEpochTime(p.DealStartEpoch), false
+	}
+
+	if d.history.ProposalSamples == 0 {
+		return time.Time{}, true
+	}
+
+	// The deal is only requested once the piece has been retrieved
+	lead := time.Duration(d.history.ProposalLeadSeconds * float64(time.Second))
+	return time.Now().Add(d.estimateRetrieval(size)).Add(lead), true
+}
+
+// Returns false if the piece can't be retrieved (when needed) and sealed before its deal starts
+// Only pieces with a pending proposal can be refused. Estimated deadlines aren't used: the estimate only
+// changes when a deal is requested, so refusing pieces on it could stop the dealbot for good
+func (d *deadlineTracker) canMeet(pieceCid string, size int64, retrieve bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, found := d.proposals[pieceCid]
+	if !found {
+		return true
+	}
+
+	needed := d.estimateSealing()
+	if retrieve {
+		needed += d.estimateRetrieval(size)
+	}
+	return time.Now().Add(needed).Before(filEpochTime(p.DealStartEpoch))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadlineTrackerCanMeet(t *testing.T) {
+	d := &deadlineTracker{sealingEstimate: 12 * time.Hour}
+
+	// Nothing known about the piece, nothing to refuse it on
+	if !d.canMeet("unknown", 1<<30, true) {
+		t.Error("pieces without a deadline should be accepted")
+	}
+
+	inHours := func(h int64) int64 {
+		return currentFilEpoch() + h*int64(time.Hour/filEpochDuration)
+	}
+	d.updateProposals([]PendingProposal{
+		{PieceCid: "soon", PieceSize: 1 << 30, DealStartEpoch: inHours(6)},
+		{PieceCid: "later", PieceSize: 1 << 30, DealStartEpoch: inHours(48)},
+	})
+
+	if d.canMeet("soon", 1<<30, false) {
+		t.Error("proposal starting before sealing can finish should be refused")
+	}
+	if !d.canMeet("later", 1<<30, false) {
+		t.Error("proposal starting in 48h should be accepted")
+	}
+
+	// 1 GiB at 32 KiB/s takes over 9 hours
+	d.recordRetrieval(1<<20, 32*time.Second)
+	if d.canMeet("later", 64<<30, true) {
+		t.Error("64 GiB retrieval should not fit before the deadline at 32 KiB/s")
+	}
+	if !d.canMeet("later", 1<<30, true) {
+		t.Error("1 GiB retrieval should fit before the deadline")
+	}
+
+	if deals := d.urgentDeals(); len(deals) != 2 || deals[0].PieceCid != "soon" {
+		t.Errorf("expected the soonest proposal first, got %+v", deals)
+	}
+}
+
+func TestDeadlineTrackerAcceptsNewPiecesAfterShortLeadTimes(t *testing.T) {
+	d := &deadlineTracker{proposals: make(map[string]PendingProposal), sealingEstimate: 12 * time.Hour}
+
+	// A proposal that started sooner than sealing takes
+	requestedAt := time.Now()
+	startEpoch := currentFilEpoch() + int64(6*time.Hour/filEpochDuration)
+	d.recordProposal(PendingProposal{DealStartEpoch: startEpoch}, requestedAt)
+
+	deadline, estimated := d.Deadline("new", 1<<30)
+	if start := filEpochTime(startEpoch); !estimated || deadline.Before(start.Add(-time.Minute)) {
+		t.Errorf("expected an estimated deadline around %v, got %v", start, deadline)
+	}
+
+	// The estimate is no reason to refuse pieces that haven't been requested yet
+	if !d.canMeet("new", 1<<30, true) {
+		t.Error("expected new pieces to be accepted whatever the lead time of earlier proposals")
+	}
+
+	// Once the piece has a proposal starting that soon, it is refused
+	d.updateProposals([]PendingProposal{{PieceCid: "new", PieceSize: 1 << 30, DealStartEpoch: startEpoch}})
+	if d.canMeet("new", 1<<30, false) {
+		t.Error("expected a proposal starting before sealing can finish to be refused")
+	}
+}
+
+func TestDeadlineTrackerSkipsImportedProposals(t *testing.T) {
+	var cfg EvergreenDealbotConfig
+	cfg.Common.StateLocation = t.TempDir()
+
+	dealDeadlines = newDeadlineTracker()
+	if err := InitDealDeadlines(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	proposals := []PendingProposal{
+		{PieceCid: "imported", DealProposalCid: "proposal-a", DealStartEpoch: currentFilEpoch() + 100},
+		{PieceCid: "waiting", DealProposalCid: "proposal-b", DealStartEpoch: currentFilEpoch() + 200},
+	}
+	dealDeadlines.updateProposals(proposals)
+	dealDeadlines.recordImport(proposals[0])
+
+	// Evergreen still lists the proposal until its deal is on chain, including after a restart
+	dealDeadlines = newDeadlineTracker()
+	if err := InitDealDeadlines(cfg); err != nil {
+		t.Fatal(err)
+	}
+	dealDeadlines.updateProposals(proposals)
+
+	if !dealDeadlines.alreadyImported("imported") || dealDeadlines.alreadyImported("waiting") {
+		t.Error("expected only the imported proposal to be skipped")
+	}
+	if deals := dealDeadlines.urgentDeals(); len(deals) != 1 || deals[0].PieceCid != "waiting" {
+		t.Errorf("expected only the proposal waiting for its data to be urgent, got %+v", deals)
+	}
+
+	// Once it's no longer pending it is forgotten
+	dealDeadlines.updateProposals(proposals[1:])
+	if len(dealDeadlines.imported) != 0 {
+		t.Errorf("expected the imported proposal to be forgotten, got %v", dealDeadlines.imported)
+	}
+}
+
+func TestDeadlineTrackerLearnsSealingTime(t *testing.T) {
+	d := &deadlineTracker{imported: make(map[string]time.Time), sealingEstimate: 12 * time.Hour}
+
+	startEpoch := currentFilEpoch() + int64(8*time.Hour/filEpochDuration)
+	p := PendingProposal{PieceCid: "piece", DealProposalCid: "proposal", PieceSize: 1 << 30, DealStartEpoch: startEpoch}
+	d.updateProposals([]PendingProposal{p})
+	if d.canMeet("piece", 1<<30, false) {
+		t.Error("expected the configured estimate to be used before any sealing time is known")
+	}
+
+	// Sealed within 2 hours of the import, well before the deal start
+	d.imported[p.DealProposalCid] = time.Now().Add(-2 * time.Hour)
+	d.updateProposals(nil)
+	if took := d.estimateSealing(); took < 2*time.Hour || took > 2*time.Hour+time.Minute {
+		t.Errorf("expected a sealing estimate around 2h, got %v", took)
+	}
+
+	d.updateProposals([]PendingProposal{p})
+	if !d.canMeet("piece", 1<<30, false) {
+		t.Error("expected the learned sealing time to be used")
+	}
+}
+
+func TestDeadlineTrackerRanksByNearestLimit(t *testing.T) {
+	d := &deadlineTracker{}
+
+	inHours := func(h int64) int64 {
+		return currentFilEpoch() + h*int64(time.Hour/filEpochDuration)
+	}
+	d.updateProposals([]PendingProposal{
+		{PieceCid: "starts-soon", DealStartEpoch: inHours(24)},
+		{PieceCid: "expires-soon", DealStartEpoch: inHours(72), HoursRemaining: 6},
+		{PieceCid: "expires-late", DealStartEpoch: inHours(48), HoursRemaining: 96},
+	})
+
+	deals := d.urgentDeals()
+	var order []string
+	for _, deal := range deals {
+		order = append(order, deal.PieceCid)
+	}
+	if len(order) != 3 || order[0] != "expires-soon" || order[1] != "starts-soon" || order[2] != "expires-late" {
+		t.Errorf("expected proposals ranked by the nearer of start and expiry, got %v", order)
+	}
+}
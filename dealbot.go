@@ -9,7 +9,7 @@ import (
 	"sync"
 	"time"
 
-	lapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/go-address"
 	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
 	log "github.com/sirupsen/logrus"
@@ -20,15 +20,8 @@ type syncMap struct {
 	m  map[string]uint
 }
 
-type syncDealsList struct {
-	mu          sync.RWMutex
-	lastQueried time.Time
-	m           []EvergreenDeal
-}
-
 var spUsageTracker = &syncMap{m: make(map[string]uint)}
 var cidsBeingQueried = &syncMap{m: make(map[string]uint)}
-var dealList = &syncDealsList{}
 
 func (s *syncMap) setValue(k string, v uint) {
 	s.mu.Lock()
@@ -42,30 +35,46 @@ func (s *syncMap) getValue(k string) uint {
 	return s.m[k]
 }
 
-func DealbotThread(done chan bool, cfg EvergreenDealbotConfig) {
-	availableDeals := getAvailableDeals_Cached(cfg)
+// Increments the count for k, unless it has already reached max
+func (s *syncMap) acquire(k string, max uint) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.m[k] >= max {
+		return false
+	}
+	s.m[k]++
+	return true
+}
+
+func (s *syncMap) release(k string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.m[k] > 0 {
+		s.m[k]--
+	}
+}
+
+func DealbotThread(done chan bool, ec EvergreenClient, cfg EvergreenDealbotConfig) {
+	// Finish the proposals we already hold before taking on new pieces
+	availableDeals := append(dealDeadlines.urgentDeals(), dealList.PrioritisedDeals()...)
 
 	if len(availableDeals) < 1 {
-		log.Error("available deals list malformed!")
+		log.Error("available deals list is empty!")
+		time.Sleep(time.Minute)
+		done <- true
 		return
 	}
 
 	attemptedCount := 0
 
 threadLoop:
-	for {
+	for _, d := range availableDeals {
 		// Only try a certain amount of deals before expiring the thread, so a new one can start
 		if attemptedCount == 1 {
 			break threadLoop
 		}
-		attemptedCount++
-		i := randomIndex(len(availableDeals))
-		d := availableDeals[i]
-
-		if d.PaddedPieceSize < cfg.Lotus.MinPieceSize {
-			// Deal is too small
-			continue
-		}
 
 		// Make sure that only one thread is querying a given CID
 		cidIsBeingQueried := cidsBeingQueried.getValue(d.PieceCid)
@@ -76,6 +85,12 @@ threadLoop:
 			continue
 		}
 
+		// Its proposal stays pending until the deal is on chain, but there's nothing left to do for it
+		if dealDeadlines.alreadyImported(d.PieceCid) {
+			log.Debugf("the pending proposal for %v has already been imported", d.PieceCid)
+			continue
+		}
+
 		// Mark the CID as being queried
 		cidsBeingQueried.setValue(d.PieceCid, 1)
 
@@ -85,64 +100,141 @@ threadLoop:
 			continue
 		}
 
+		// Don't start on a piece that keeps failing, or whose sources all do, unless a local CAR exists
+		needsRetrieval := !FileExists(GenerateCarFileName(cfg.Common.CarLocationLongterm, d.PieceCid))
+		if needsRetrieval && !sourceBreakers.pieceAllowed(d.PieceCid, d.Sources) {
+			log.Debugf("circuit breakers are open for %v", d.PieceCid)
+			cidsBeingQueried.setValue(d.PieceCid, 0)
+			continue
+		}
+
+		// Don't start on a piece that can't be sealed before its deal starts
+		if !dealDeadlines.canMeet(d.PieceCid, d.PaddedPieceSize, needsRetrieval) {
+			log.Debugf("not enough time left to seal %v before its deal start", d.PieceCid)
+			cidsBeingQueried.setValue(d.PieceCid, 0)
+			continue
+		}
+
+		// Check the tenant lists and quotas before spending anything on the piece
+		tenantId, tenantOk := tenantPolicy.reserve(d)
+		if !tenantOk {
+			log.Debugf("no allowed tenant with quota left for %v", d.PieceCid)
+			cidsBeingQueried.setValue(d.PieceCid, 0)
+			continue
+		}
+
+		// Don't start on a piece that would go over the Evergreen pending bytes cap
+		// Pieces with a pending proposal are already counted by Evergreen
+		_, alreadyProposed := dealDeadlines.proposal(d.PieceCid)
+		if !alreadyProposed && !pendingBytes.reserve(d.PieceCid, d.PaddedPieceSize) {
+			log.Debugf("no pending bytes headroom left for %v", d.PieceCid)
+			wakeProposalPollers()
+			tenantPolicy.release(tenantId, d.PaddedPieceSize)
+			cidsBeingQueried.setValue(d.PieceCid, 0)
+			continue
+		}
+
+		attemptedCount++
 		pieceCid := d.PieceCid
+		pieceSize := d.PaddedPieceSize
 		payloadCid := d.Sources[0].OriginalPayloadCid // Should all be the same payloadCid
 
+		activeJobs.start(pieceCid, pieceSize)
+		finishPiece := func() {
+			activeJobs.finish(pieceCid)
+			pendingBytes.release(pieceCid)
+			tenantPolicy.release(tenantId, pieceSize)
+			cidsBeingQueried.setValue(pieceCid, 0)
+		}
+
 		log.Trace("thread is querying for " + pieceCid)
 
-		localImportSuccess := attemptDeal_Local(pieceCid, payloadCid, cfg)
+		// Once the deal is requested, finishPiece is called after the import instead
+		localImportSuccess := attemptDeal_Local(pieceCid, payloadCid, pieceSize, tenantId, ec, cfg, finishPiece)
 		if localImportSuccess {
-			log.Debug("successfully acquired deal" + d.PieceCid)
-			cidsBeingQueried.setValue(d.PieceCid, 0)
+			log.Debug("successfully requested deal " + d.PieceCid)
 			break threadLoop
 		}
 
-		retrievalSuccess := false
-		// Try all the different sources (SPs) for a deal
-		for _, source := range d.Sources {
-			providerId := source.ProviderID
+		allowedSources := sourceBreakers.startPiece(pieceCid, d.Sources)
+		if len(allowedSources) == 0 {
+			log.Debugf("circuit breakers are open for all sources of %v", pieceCid)
+			finishPiece()
+			continue
+		}
 
-			// Separate Lock / Unlock calls here, to ensure value does not change while we check MaxConcurrent
-			spUsageTracker.mu.Lock()
-			spCount := spUsageTracker.m[providerId]
+		// Race several sources at once if there's more than one to pick from
+		if cfg.Lotus.RetrievalRaceSources > 1 && len(allowedSources) > 1 {
+			if attemptDeal_Race(pieceCid, payloadCid, pieceSize, tenantId, allowedSources, ec, cfg, finishPiece) {
+				break threadLoop
+			}
+			sourceBreakers.pieceFailed(pieceCid, d.Sources)
+			finishPiece()
+			continue
+		}
 
-			if spCount >= cfg.Evergreen.MaxConcurrentRetrievalsPerSp {
-				log.Debug("reached max concurrent queries for SP " + providerId)
-				spUsageTracker.mu.Unlock()
-				continue
+		// Try the different sources (SPs) for a deal, cheapest acceptable offer first
+		// Sources whose query failed go last, by reputation, in case the failure was a passing one
+		sources := allowedSources
+		if len(sources) > 1 {
+			sources = nil
+			offered := make(map[string]bool)
+			for _, c := range queryOffers(context.Background(), retrievalBackends, pieceCid, payloadCid, pieceSize, allowedSources) {
+				sources = append(sources, c.source)
+				offered[c.source.ProviderID] = true
 			}
-			// Mark the SP as being queried
-			spUsageTracker.m[providerId] = spCount + 1
-			spUsageTracker.mu.Unlock()
+			for _, source := range spReputations.rank(allowedSources) {
+				if !offered[source.ProviderID] {
+					sources = append(sources, source)
+				}
+			}
+		}
 
-			log.Debug("trying SP " + providerId)
+		for _, source := range sources {
+			providerId := source.ProviderID
 
-			retrievalSuccess = attemptDeal_Retrieval(pieceCid, payloadCid, providerId, cfg)
+			if len(allowedSources) == 1 && spReputations.chronic(providerId) {
+				log.Debugf("skipping SP %s for %v, it has been failing retrievals", providerId, pieceCid)
+				break
+			}
 
-			if !retrievalSuccess {
-				log.Debug("failed to retrieve deal from SP " + providerId)
+			// Failed sources use up time, stop once the piece could no longer make its deadline
+			if !dealDeadlines.canMeet(pieceCid, d.PaddedPieceSize, true) {
+				log.Infof("not enough time left to retrieve and seal %v, giving up", pieceCid)
+				break
+			}
 
-				spCount = spUsageTracker.getValue(providerId)
-				spUsageTracker.setValue(providerId, spCount-1)
+			if !spUsageTracker.acquire(providerId, cfg.Evergreen.MaxConcurrentRetrievalsPerSp) {
+				log.Debug("reached max concurrent queries for SP " + providerId)
 				continue
 			}
 
+			log.Debug("trying SP " + providerId)
+
+			retrievalSuccess := attemptDeal_Retrieval(pieceCid, payloadCid, pieceSize, tenantId, source, ec, cfg, finishPiece)
+			spUsageTracker.release(providerId)
+
 			if retrievalSuccess {
-				spCount = spUsageTracker.getValue(providerId)
-				spUsageTracker.setValue(providerId, spCount-1)
-				cidsBeingQueried.setValue(d.PieceCid, 0)
 				break threadLoop
 			}
+			log.Debug("failed to retrieve deal from SP " + providerId)
 		}
 
-		cidsBeingQueried.setValue(d.PieceCid, 0)
+		sourceBreakers.pieceFailed(pieceCid, d.Sources)
+		finishPiece()
+	}
+
+	if attemptedCount == 0 {
+		// Nothing we can take right now, don't spin
+		log.Debug("no deal could be attempted, waiting before trying again")
+		time.Sleep(time.Minute)
 	}
 
 	done <- true
 }
 
 // Periodically checks a directory for CAR files, creating a deal for any CARs that also have available deals
-func WatcherThread(cfg EvergreenDealbotConfig) {
+func WatcherThread(ec EvergreenClient, cfg EvergreenDealbotConfig) {
 	for {
 		carFiles, err := getCARFilesInDir(cfg.Common.CarLocationLongterm)
 		if err != nil {
@@ -151,7 +243,7 @@ func WatcherThread(cfg EvergreenDealbotConfig) {
 
 		log.Trace("watcherThread found %d CAR files", len(carFiles))
 
-		availableDeals := getAvailableDeals_Cached(cfg)
+		availableDeals := dealList.Deals()
 		adMap := make(map[string]EvergreenDeal)
 
 		// Put deals in a map, indexed by PieceCid for faster lookup below
@@ -164,16 +256,32 @@ func WatcherThread(cfg EvergreenDealbotConfig) {
 
 			deal, found := adMap[pieceCid]
 			if found {
+				if cidsBeingQueried.getValue(pieceCid) == 1 {
+					continue
+				}
+
+				tenantId, tenantOk := tenantPolicy.reserve(deal)
+				if !tenantOk {
+					log.Debugf("no allowed tenant with quota left for local CAR %v", pieceCid)
+					continue
+				}
+
 				// Mark the CID as being queried
 				cidsBeingQueried.setValue(pieceCid, 1)
+				activeJobs.start(pieceCid, deal.PaddedPieceSize)
 
 				// Matching deal found!
 				// TODO: Potentially run on a separate thread to avoid blocking this one
 
 				// log.Debugf("watcher thread found an open deal for %v", pieceCid)
-				attemptDeal_Local(pieceCid, deal.Sources[0].OriginalPayloadCid, cfg)
-
-				cidsBeingQueried.setValue(pieceCid, 0)
+				finish := func() {
+					activeJobs.finish(pieceCid)
+					tenantPolicy.release(tenantId, deal.PaddedPieceSize)
+					cidsBeingQueried.setValue(pieceCid, 0)
+				}
+				if !attemptDeal_Local(pieceCid, deal.Sources[0].OriginalPayloadCid, deal.PaddedPieceSize, tenantId, ec, cfg, finish) {
+					finish()
+				}
 			}
 		}
 
@@ -182,8 +290,9 @@ func WatcherThread(cfg EvergreenDealbotConfig) {
 }
 
 // Attempts to import the file from long-term CAR storage
-// Returns true if import was successful, false if file not found or proposal failed
-func attemptDeal_Local(pieceCid string, payloadCid string, cfg EvergreenDealbotConfig) bool {
+// Returns true if the deal was requested, false if file not found or the request failed
+// finish is called once the import is done, see acquireDeal
+func attemptDeal_Local(pieceCid string, payloadCid string, pieceSize int64, tenantId int64, ec EvergreenClient, cfg EvergreenDealbotConfig, finish func()) bool {
 	destinationFile := GenerateCarFileName(cfg.Common.CarLocationLongterm, pieceCid)
 	carExists := FileExists(destinationFile)
 
@@ -192,62 +301,41 @@ func attemptDeal_Local(pieceCid string, payloadCid string, cfg EvergreenDealbotC
 	}
 	log.Debugf("attempting to import CAR file locally from %v", destinationFile)
 
-	storageMinerApi, smCloser, err := StorageMinerConnection(cfg.Lotus.MinerApiInfo)
-	defer smCloser()
-	if err != nil {
-		// Lotus connection error
-		log.Error(err)
-	}
-
-	proposalCid, err := proposeDeal(pieceCid, storageMinerApi, cfg)
-	if err != nil {
-		log.Debug(err)
+	activeJobs.setStage(pieceCid, jobVerifying, "")
+	if err := VerifyCar(destinationFile, pieceCid, payloadCid, pieceSize, "", cfg); err != nil {
+		log.Errorf("local CAR failed verification: %s", err)
 		return false
 	}
+	sourceBreakers.sourceSucceeded(pieceCid, "")
 
-	importDeal(proposalCid, destinationFile, cfg)
-
-	return true
+	return acquireDeal(pieceCid, destinationFile, tenantId, ec, cfg, finish)
 }
 
 // Attempts to retrieve the CAR file from the peer SP
-// Returns true if import was successful, false if not
-func attemptDeal_Retrieval(pieceCid string, payloadCid string, sourceSp string, cfg EvergreenDealbotConfig) bool {
+// Returns true if the deal was requested, false if not
+// finish is called once the import is done, see acquireDeal
+func attemptDeal_Retrieval(pieceCid string, payloadCid string, pieceSize int64, tenantId int64, source Source, ec EvergreenClient, cfg EvergreenDealbotConfig, finish func()) bool {
 	destinationFile := GenerateCarFileName(cfg.Common.CarLocationDownload, pieceCid)
-	res, err := RetrieveCar(payloadCid, sourceSp, destinationFile, cfg)
+	activeJobs.setStage(pieceCid, jobRetrieving, source.ProviderID)
 
-	if !res || err != nil {
-		// CAR retrieve failed
-		log.Debugf("cancelling transfer due to error: %s", err)
-		time.Sleep(time.Second * 30) // Wait 30 seconds, transfer may take some time to show up
-		err := CancelRetrieval(payloadCid, cfg)
-		if err != nil {
-			log.Debugf("cancel failed: %s \n", err)
-		} else {
-			log.Debugf("successfully cancelled retrieval %v", payloadCid)
-		}
+	retrievalStart := time.Now()
+	err := retrievalBackends.Retrieve(context.Background(), pieceCid, payloadCid, pieceSize, source, destinationFile, func(received int64, total int64) {
+		activeJobs.setReceived(pieceCid, received)
+	})
+	if err != nil {
 		log.Debugln(err)
-
 		return false
 	}
 
-	log.Debugf("successfully retrieved CAR %v", pieceCid)
-
-	storageMinerApi, smCloser, err := StorageMinerConnection(cfg.Lotus.MinerApiInfo)
-	defer smCloser()
-	if err != nil {
-		// Lotus connection error
-		log.Error(err)
+	log.Debugf("successfully retrieved and verified CAR %v", pieceCid)
+	if info, err := os.Stat(destinationFile); err == nil {
+		dealDeadlines.recordRetrieval(info.Size(), time.Since(retrievalStart))
 	}
 
-	proposalCid, err := proposeDeal(pieceCid, storageMinerApi, cfg)
-	if err != nil {
-		log.Debug(err)
+	if !acquireDeal(pieceCid, destinationFile, tenantId, ec, cfg, finish) {
 		return false
 	}
 
-	importDeal(proposalCid, destinationFile, cfg)
-
 	// Move the CAR to long term storage
 	// Wait a bit to make sure import doesn't need it any more
 	// time.Sleep(time.Second * 30)
@@ -259,102 +347,144 @@ func attemptDeal_Retrieval(pieceCid string, payloadCid string, sourceSp string,
 	return true
 }
 
-// Requests a deal, then queries Evergreen until it's accepted and returns the Proposal CID
-func proposeDeal(pieceCid string, storageMinerApi lapi.StorageMiner, cfg EvergreenDealbotConfig) (string, error) {
-	spid, err := storageMinerApi.ActorAddress(context.Background())
+// Retrieves the piece by racing up to RETRIEVAL_RACE_SOURCES of the sources that make an offer, cheapest first
+// Returns true if the deal was requested, see acquireDeal
+func attemptDeal_Race(pieceCid string, payloadCid string, pieceSize int64, tenantId int64, sources []Source, ec EvergreenClient, cfg EvergreenDealbotConfig, finish func()) bool {
+	destinationFile := GenerateCarFileName(cfg.Common.CarLocationDownload, pieceCid)
+	activeJobs.setStage(pieceCid, jobRetrieving, "")
+
+	candidates := queryOffers(context.Background(), retrievalBackends, pieceCid, payloadCid, pieceSize, sources)
+	if len(candidates) == 0 {
+		log.Debugf("none of the %d sources made an offer for %v", len(sources), pieceCid)
+		return false
+	}
+	activeJobs.setStage(pieceCid, jobRetrieving, fmt.Sprintf("%d sources", len(candidates)))
+
+	retrievalStart := time.Now()
+	source, err := raceRetrieval(context.Background(), retrievalBackends, pieceCid, payloadCid, pieceSize, candidates,
+		int(cfg.Lotus.RetrievalRaceSources), spUsageTracker, cfg.Evergreen.MaxConcurrentRetrievalsPerSp, destinationFile,
+		func(received int64, total int64) {
+			activeJobs.setReceived(pieceCid, received)
+		})
 	if err != nil {
-		return "", fmt.Errorf("failed getting SPID: %s", err)
+		log.Debugln(err)
+		return false
 	}
 
-	rDealResponse, err := RequestDeal(spid, pieceCid, cfg)
-	if err != nil || rDealResponse.ResponseCode != 200 {
-		// If this happens it's likely the deal was taken by someone else while we were downloading
-		return "", fmt.Errorf("failed requesting deal %s\n", err)
+	log.Debugf("successfully retrieved and verified CAR %v from %s", pieceCid, source.ProviderID)
+	if info, err := os.Stat(destinationFile); err == nil {
+		dealDeadlines.recordRetrieval(info.Size(), time.Since(retrievalStart))
 	}
 
-	proposalCid := ""
-	retries := 0
+	return acquireDeal(pieceCid, destinationFile, tenantId, ec, cfg, finish)
+}
 
-	// Repeatedly try to find the Deal Proposal CID
-	for {
-		if retries >= 15 {
-			return "", fmt.Errorf("could not find deal after 15 retries")
-		}
+// How long to wait for a requested deal to show up in the pending proposals
+const proposalWaitTimeout = 15 * time.Minute
 
-		// Wait a minute in between tries, it may take time for it to show up on Evergreen API
-		time.Sleep(60 * time.Second)
-		retries += 1
+// How many deals each dealbot thread may leave waiting for their proposal and import in the background
+const proposalWaitersPerThread = 4
 
-		response, err := GetPendingProposals(spid, cfg)
+// Slots for deals waiting in the background, see acquireDeal
+var proposalWaiters chan struct{}
 
-		if err != nil {
-			log.Debug(err)
-			continue
-		} else {
-			var success bool
-			success, proposalCid = findDealProposalCid(response.Response.PendingProposals, pieceCid)
+// Allows MAX_THREADS * proposalWaitersPerThread deals to wait in the background at once
+func InitProposalWaiters(cfg EvergreenDealbotConfig) {
+	proposalWaiters = make(chan struct{}, cfg.Common.MaxThreads*proposalWaitersPerThread)
+}
 
-			if !success {
-				continue
-			} else {
-				log.Debug("successfully got deal proposal")
-				break
-			}
-		}
+// Requests the deal from Evergreen, then waits for the proposal and imports the CAR in the background,
+// so the calling thread doesn't hold a worker slot while Evergreen makes the proposal
+// Returns true if the deal was requested, in which case finish is called once the import is done or given up on.
+// Otherwise the caller is left to clean up. Blocks while the most deals allowed are already waiting
+// The import is counted against tenantId, the tenant reserved for the piece
+func acquireDeal(pieceCid string, carFile string, tenantId int64, ec EvergreenClient, cfg EvergreenDealbotConfig, finish func()) bool {
+	spid, err := MinerActorAddress(cfg.Lotus.MinerApiInfo)
+	if err != nil {
+		log.Error(err)
+		return false
 	}
-	return proposalCid, nil
-}
 
-// Search through a list of pending proposals for a given pieceCid
-// returns (true, proposalCid) if found, (false, "") otherwise
-func findDealProposalCid(p []PendingProposal, pieceCid string) (bool, string) {
-	// bafyreifkzrbx5lrognvw7jgpviuhnw2z7vtvx242rdkgpyibd3yutcodma
-	for _, v := range p {
-		if v.PieceCid == pieceCid {
-			return true, v.DealProposalCid
-		}
+	activeJobs.setStage(pieceCid, jobProposing, "")
+
+	select {
+	case proposalWaiters <- struct{}{}:
+	default:
+		log.Debugf("%d deals are already waiting for their proposal or import, waiting for a free slot", cap(proposalWaiters))
+		proposalWaiters <- struct{}{}
 	}
-	return false, ""
-}
 
-// Gets available deals, using the cached version first if available or querying and updating the cache if not
-func getAvailableDeals_Cached(cfg EvergreenDealbotConfig) []EvergreenDeal {
-	// TODO: queryInterval shouldn't be passed in as a param here
-	qi := time.Duration(cfg.Evergreen.DealRequeryInterval) * time.Minute
+	// The deal may have been requested on an earlier attempt, and even imported already
+	proposal, alreadyProposed := dealDeadlines.proposal(pieceCid)
+	if alreadyProposed && dealDeadlines.alreadyImported(pieceCid) {
+		log.Debugf("the pending proposal for %v has already been imported", pieceCid)
+		<-proposalWaiters
+		return false
+	}
 
-	dealList.mu.Lock()
-	lastQueried := dealList.lastQueried
-	deals := dealList.m
+	requestedAt := time.Now()
+	if alreadyProposed {
+		log.Debugf("using the pending proposal for %v", pieceCid)
+	} else if err := requestDeal(pieceCid, spid, ec); err != nil {
+		log.Debug(err)
+		<-proposalWaiters
+		return false
+	}
 
-	if time.Since(lastQueried) > qi {
-		storageMinerApi, smCloser, err := StorageMinerConnection(cfg.Lotus.MinerApiInfo)
-		defer smCloser()
-		if err != nil {
-			// Lotus connection error
-			log.Error(err)
-		}
+	go func() {
+		defer finish()
+		defer func() { <-proposalWaiters }()
 
-		spid, err := storageMinerApi.ActorAddress(context.Background())
-		if err != nil {
-			log.Errorf("failed getting SPID: %s\n", err)
+		if !alreadyProposed {
+			p, err := ProposalPollerFor(ec, spid).Wait(pieceCid, proposalWaitTimeout)
+			if err != nil {
+				log.Debug(err)
+				return
+			}
+
+			log.Debug("successfully got deal proposal")
+			dealDeadlines.recordProposal(*p, requestedAt)
+			proposal = *p
 		}
 
-		newDeals, err := QueryAvailableDeals(spid, cfg)
+		importProposal(proposal, tenantId, carFile, cfg)
+	}()
 
-		if err != nil {
-			log.Errorf("Unable to retrieve Available Deals list. %s", err)
-			return deals
-		}
+	return true
+}
 
-		dealList.lastQueried = time.Now()
-		dealList.m = newDeals.Response
-		dealList.mu.Unlock()
+// Requests a deal from Evergreen, recording the pending bytes and replica counts it returns
+func requestDeal(pieceCid string, spid address.Address, ec EvergreenClient) error {
+	rDealResponse, err := ec.RequestDeal(spid, pieceCid)
+	if err != nil {
+		// If this happens it's likely the deal was taken by someone else while we were downloading
+		return fmt.Errorf("failed requesting deal %s\n", err)
+	}
+
+	pendingBytes.requested(pieceCid, rDealResponse.Response)
+	dealList.learnReplicas(pieceCid, rDealResponse.Response.TentativeReplicaCounts)
+	return nil
+}
+
+// Imports the CAR for a proposal, and counts the import against the tenant reserved for the piece
+// Proposals for tenants that aren't allowed are refused, leaving finish to release the reservation
+func importProposal(proposal PendingProposal, tenantId int64, carFile string, cfg EvergreenDealbotConfig) {
+	// Importing now would only have the deal fail on chain
+	if !dealDeadlines.canMeet(proposal.PieceCid, proposal.PieceSize, false) {
+		log.Warnf("proposal for %v starts at epoch %d, not enough time left to seal it", proposal.PieceCid, proposal.DealStartEpoch)
+		return
+	}
+
+	// Evergreen picks the tenant of the proposal, which may not be one the tenant lists allow
+	if !tenantPolicy.allows(proposal.TenantID) {
+		log.Warnf("proposal for %v is for tenant %d, which isn't allowed", proposal.PieceCid, proposal.TenantID)
+		return
+	}
 
-		log.Debugf("found %d open deals", len(newDeals.Response))
-		return newDeals.Response
-	} else {
-		dealList.mu.Unlock()
-		return deals
+	activeJobs.setStage(proposal.PieceCid, jobImporting, "")
+	if importDeal(proposal.DealProposalCid, carFile, cfg) {
+		dealDeadlines.recordImport(proposal)
+		tenantPolicy.recordImport(tenantId, proposal.PieceSize)
 	}
 }
 
@@ -2,34 +2,64 @@ package main
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/filecoin-project/go-address"
 	log "github.com/sirupsen/logrus"
 )
 
-func RequestDeal(spid address.Address, pieceCid string, cfg EvergreenDealbotConfig) (*RequestDealResponse, error) {
-	req, err := http.NewRequest("GET", "https://api.evergreen.filecoin.io/sp/request_piece/"+pieceCid, nil)
-	if err != nil {
-		return nil, err
-	}
+// Client for the Evergreen SP API
+// https://github.com/filecoin-project/evergreen-dealer
+type EvergreenClient interface {
+	RequestDeal(spid address.Address, pieceCid string) (*RequestDealResponse, error)
+	GetPendingProposals(spid address.Address) (*PendingProposalsResponse, error)
+	QueryAvailableDeals(spid address.Address, keep DealFilter) (*AvailableDeals, error)
+}
 
-	authCode, err := evergreenFilSPID(spid, cfg)
+// Decides whether an eligible piece is kept while decoding the available deals list
+type DealFilter func(d *EvergreenDeal) bool
+
+// Default EvergreenClient implementation, talking to the Evergreen API over HTTP
+type HttpEvergreenClient struct {
+	baseUrl    string
+	userAgent  string
+	maxRetries uint
+	httpClient *http.Client
+	authHeader func(spid address.Address) (string, error)
+	// Called with a header Evergreen refused, if set
+	rejectAuth func(spid address.Address, header string)
+}
+
+func NewEvergreenClient(cfg EvergreenDealbotConfig) (*HttpEvergreenClient, error) {
+	signer, err := NewFilSPIDSigner(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", strings.TrimSuffix(authCode, "\n"))
-	persistentClient := PersistentHeaderHttpClient(req)
-
-	resp, err := persistentClient.Do(req)
+	tokens, err := NewFilSPIDTokenProvider(signer, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	timeout := time.Duration(cfg.Evergreen.ApiTimeout) * time.Second
+	connectTimeout := time.Duration(cfg.Evergreen.ApiConnectTimeout) * time.Second
+
+	return &HttpEvergreenClient{
+		baseUrl:    strings.TrimSuffix(cfg.Evergreen.ApiUrl, "/"),
+		userAgent:  cfg.Evergreen.UserAgent,
+		maxRetries: cfg.Evergreen.ApiMaxRetries,
+		httpClient: PersistentHeaderHttpClient(timeout, connectTimeout),
+		authHeader: tokens.Token,
+		rejectAuth: tokens.Invalidate,
+	}, nil
+}
+
+func (c *HttpEvergreenClient) RequestDeal(spid address.Address, pieceCid string) (*RequestDealResponse, error) {
+	body, err := c.get(spid, "/sp/request_piece/"+pieceCid)
 	if err != nil {
 		return nil, err
 	}
@@ -42,69 +72,138 @@ func RequestDeal(spid address.Address, pieceCid string, cfg EvergreenDealbotConf
 	return &result, nil
 }
 
-func GetPendingProposals(spid address.Address, cfg EvergreenDealbotConfig) (*PendingProposalsResponse, error) {
-	req, err := http.NewRequest("GET", "https://api.evergreen.filecoin.io/sp/pending_proposals", nil)
+func (c *HttpEvergreenClient) GetPendingProposals(spid address.Address) (*PendingProposalsResponse, error) {
+	body, err := c.get(spid, "/sp/pending_proposals")
 	if err != nil {
 		return nil, err
 	}
 
-	authCode, err := evergreenFilSPID(spid, cfg)
+	result, err := UnmarshalPendingProposalsResponse(body)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", strings.TrimSuffix(authCode, "\n"))
-	persistentClient := PersistentHeaderHttpClient(req)
-	resp, err := persistentClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
+	return &result, nil
+}
+
+// Most eligible pieces asked for at once. Pieces are decoded one at a time, so this can be well above what
+// Evergreen usually lists without using much memory
+const eligiblePiecesLimit = 100000
+
+// Streams the eligible pieces list, only keeping the pieces accepted by keep (or all of them if keep is nil)
+// Warns when the list looks cut short, as the pieces past the limit are never seen
+func (c *HttpEvergreenClient) QueryAvailableDeals(spid address.Address, keep DealFilter) (*AvailableDeals, error) {
+	log.Debug("Querying for available deals...")
 
-	body, err := ioutil.ReadAll(resp.Body)
+	var result *AvailableDeals
+	path := fmt.Sprintf("/sp/eligible_pieces?limit=%d", eligiblePiecesLimit)
+	err := c.getStream(spid, path, func(r io.Reader) (*apiResponseHeader, error) {
+		var err error
+		result, err = DecodeAvailableDeals(r, keep)
+		if err != nil {
+			return nil, err
+		}
+
+		return &apiResponseHeader{
+			RequestID:    result.RequestID,
+			ResponseCode: result.ResponseCode,
+			InfoLines:    result.InfoLines,
+		}, nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	result, err := UnmarshalPendingProposalsResponse(body)
-	if err != nil {
-		return nil, err
+	if result.ResponseEntries > result.Decoded {
+		log.Warnf("evergreen listed %d eligible pieces but only %d were received", result.ResponseEntries, result.Decoded)
+	} else if result.Decoded >= eligiblePiecesLimit {
+		log.Warnf("evergreen listed %d eligible pieces, the most asked for, some may have been left out", result.Decoded)
 	}
 
-	return &result, nil
+	log.Debugf("kept %d of %d eligible pieces", len(result.Response), result.Decoded)
+	return result, nil
 }
 
-func QueryAvailableDeals(spid address.Address, cfg EvergreenDealbotConfig) (*AvailableDeals, error) {
-	log.Debug("Querying for available deals...")
+// Decodes an eligible_pieces response one piece at a time, so the full list never has to be held in memory
+func DecodeAvailableDeals(r io.Reader, keep DealFilter) (*AvailableDeals, error) {
+	var result AvailableDeals
+	dec := json.NewDecoder(r)
 
-	req, err := http.NewRequest("GET", "https://api.evergreen.filecoin.io/sp/eligible_pieces?limit=100000", nil)
-	if err != nil {
+	if err := expectDelim(dec, '{'); err != nil {
 		return nil, err
 	}
 
-	authCode, err := evergreenFilSPID(spid, cfg)
-	if err != nil {
-		return nil, err
+	fields := map[string]interface{}{
+		"request_id":           &result.RequestID,
+		"response_timestamp":   &result.ResponseTimestamp,
+		"response_state_epoch": &result.ResponseStateEpoch,
+		"response_code":        &result.ResponseCode,
+		"info_lines":           &result.InfoLines,
+		"response_entries":     &result.ResponseEntries,
 	}
 
-	req.Header.Set("Authorization", strings.TrimSuffix(authCode, "\n"))
-	persistentClient := PersistentHeaderHttpClient(req)
-	resp, err := persistentClient.Do(req)
-	if err != nil {
-		return nil, err
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := t.(string)
+
+		if key != "response" {
+			target, known := fields[key]
+			if !known {
+				target = &json.RawMessage{}
+			}
+			if err := dec.Decode(target); err != nil {
+				return nil, fmt.Errorf("decoding %s: %s", key, err)
+			}
+			continue
+		}
+
+		// The response list is null on errors
+		t, err = dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			continue
+		}
+		if d, ok := t.(json.Delim); !ok || d != '[' {
+			return nil, fmt.Errorf("expected response to be a list, got %v", t)
+		}
+
+		for dec.More() {
+			var deal EvergreenDeal
+			if err := dec.Decode(&deal); err != nil {
+				return nil, fmt.Errorf("decoding eligible piece: %s", err)
+			}
+			result.Decoded++
+			if keep == nil || keep(&deal) {
+				result.Response = append(result.Response, deal)
+			}
+		}
+
+		if err := expectDelim(dec, ']'); err != nil {
+			return nil, err
+		}
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	if err := expectDelim(dec, '}'); err != nil {
 		return nil, err
 	}
 
-	result, err := UnmarshalAvailableDeals(body)
+	return &result, nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	return &result, err
-
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("malformed response: expected %v, got %v", delim, t)
+	}
+	return nil
 }
 
 // ########### TYPES
@@ -187,6 +286,7 @@ type AvailableDeals struct {
 	InfoLines          []string        `json:"info_lines"`
 	ResponseEntries    int64           `json:"response_entries"`
 	Response           []EvergreenDeal `json:"response"`
+	Decoded            int64           `json:"-"` // Pieces in the response, before filtering
 }
 
 type EvergreenDeal struct {
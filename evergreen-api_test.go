@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+)
+
+func testEvergreenClient(url string) *HttpEvergreenClient {
+	return &HttpEvergreenClient{
+		baseUrl:    url,
+		userAgent:  "dealbot-test",
+		maxRetries: 3,
+		httpClient: PersistentHeaderHttpClient(10*time.Second, 10*time.Second),
+		authHeader: func(spid address.Address) (string, error) {
+			return "FIL-SPID-V0 1;" + spid.String() + ";1;sig\n", nil
+		},
+	}
+}
+
+func TestEvergreenClientUsesConfiguredEndpoint(t *testing.T) {
+	spid, _ := address.NewIDAddress(1234)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sp/request_piece/baga6ea4seaqtest" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if got := r.Header.Get("User-Agent"); got != "dealbot-test" {
+			t.Errorf("unexpected user agent: %q", got)
+		}
+		if got := r.Header.Get("Authorization"); got != "FIL-SPID-V0 1;"+spid.String()+";1;sig" {
+			t.Errorf("unexpected authorization header: %q", got)
+		}
+		w.Write([]byte(`{"request_id":"abc","response_code":200,"response":{"bytes_pending_current":1,"bytes_pending_max":2}}`))
+	}))
+	defer srv.Close()
+
+	res, err := testEvergreenClient(srv.URL).RequestDeal(spid, "baga6ea4seaqtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.RequestID != "abc" || res.Response.BytesPendingMax != 2 {
+		t.Errorf("unexpected response: %+v", res)
+	}
+}
+
+func TestEvergreenClientRetriesTransientErrors(t *testing.T) {
+	spid, _ := address.NewIDAddress(1234)
+	var calls int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"request_id":"abc","response_code":200,"response":{"pending_proposals":[]}}`))
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	_, err := testEvergreenClient(srv.URL).GetPendingProposals(spid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected 2 calls, got %d", n)
+	}
+	// Retry-After: 0 means straight away, without the backoff jitter
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected an immediate retry, took %v", elapsed)
+	}
+}
+
+func TestEvergreenClientRetriesDroppedConnections(t *testing.T) {
+	spid, _ := address.NewIDAddress(1234)
+	var calls int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`{"request_id":"abc","response_code":200,"response":{"pending_proposals":[]}}`))
+	}))
+	defer srv.Close()
+
+	if _, err := testEvergreenClient(srv.URL).GetPendingProposals(spid); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected 2 calls, got %d", n)
+	}
+}
+
+func TestEvergreenClientDoesNotRetrySigningFailures(t *testing.T) {
+	spid, _ := address.NewIDAddress(1234)
+
+	c := testEvergreenClient("http://127.0.0.1:0")
+	signs := 0
+	c.authHeader = func(spid address.Address) (string, error) {
+		signs++
+		return "", fmt.Errorf("worker key not in wallet")
+	}
+
+	if _, err := c.GetPendingProposals(spid); err == nil {
+		t.Fatal("expected the signing failure to be returned")
+	}
+	if signs != 1 {
+		t.Errorf("expected signing to be tried once, got %d", signs)
+	}
+}
+
+func TestEvergreenClientReturnsAPIError(t *testing.T) {
+	spid, _ := address.NewIDAddress(1234)
+	var calls int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"request_id":"abc","response_code":403,"info_lines":["piece already claimed"]}`))
+	}))
+	defer srv.Close()
+
+	_, err := testEvergreenClient(srv.URL).RequestDeal(spid, "baga6ea4seaqtest")
+
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		t.Fatalf("expected an APIError, got %v", err)
+	}
+	if apiErr.RequestID != "abc" || apiErr.HttpStatus != 403 || apiErr.ResponseCode != 403 || len(apiErr.InfoLines) != 1 {
+		t.Errorf("unexpected error fields: %+v", apiErr)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("non-transient errors should not be retried, got %d calls", n)
+	}
+}
+
+func TestEvergreenClientDropsRefusedAuth(t *testing.T) {
+	spid, _ := address.NewIDAddress(1234)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"request_id":"abc","response_code":401,"info_lines":["signature expired"]}`))
+	}))
+	defer srv.Close()
+
+	c := testEvergreenClient(srv.URL)
+	var rejected []string
+	c.rejectAuth = func(spid address.Address, header string) {
+		rejected = append(rejected, header)
+	}
+
+	if _, err := c.GetPendingProposals(spid); err == nil {
+		t.Fatal("expected the request to fail")
+	}
+	if len(rejected) != 1 || rejected[0] != "FIL-SPID-V0 1;"+spid.String()+";1;sig\n" {
+		t.Errorf("expected the refused header to be dropped, got %q", rejected)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d, ok := parseRetryAfter("7"); !ok || d != 7*time.Second {
+		t.Errorf("expected 7s, got %v", d)
+	}
+	if d, ok := parseRetryAfter("0"); !ok || d != 0 {
+		t.Errorf("expected 0 to be an immediate retry, got %v", d)
+	}
+	if d, ok := parseRetryAfter(time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)); !ok || d != 0 {
+		t.Errorf("expected 0 for a date in the past, got %v", d)
+	}
+	if _, ok := parseRetryAfter("garbage"); ok {
+		t.Error("expected an invalid value to be ignored")
+	}
+	if _, ok := parseRetryAfter(""); ok {
+		t.Error("expected a missing header to be ignored")
+	}
+}
+
+func TestDecodeAvailableDealsFiltersWhileStreaming(t *testing.T) {
+	body := `{
+		"request_id": "abc",
+		"response_code": 200,
+		"response_state_epoch": 2205910,
+		"unknown_field": {"nested": [1, 2, 3]},
+		"response_entries": 3,
+		"response": [
+			{"piece_cid": "small", "padded_piece_size": 1024, "sources": [{"provider_id": "f01"}]},
+			{"piece_cid": "large", "padded_piece_size": 34359738368, "tenants": [1], "sources": [{"provider_id": "f02"}]},
+			{"piece_cid": "nosource", "padded_piece_size": 34359738368, "sources": []}
+		]
+	}`
+
+	var cfg EvergreenDealbotConfig
+	cfg.Lotus.MinPieceSize = 1 << 30
+
+	deals, err := DecodeAvailableDeals(strings.NewReader(body), eligibleDealFilter(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deals.RequestID != "abc" || deals.ResponseStateEpoch != 2205910 || deals.ResponseEntries != 3 || deals.Decoded != 3 {
+		t.Errorf("unexpected response fields: %+v", deals)
+	}
+	if len(deals.Response) != 1 || deals.Response[0].PieceCid != "large" {
+		t.Errorf("expected only the large piece to be kept, got %+v", deals.Response)
+	}
+}
+
+func TestEvergreenClientAsksForEligiblePiecesLimit(t *testing.T) {
+	spid, _ := address.NewIDAddress(1234)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sp/eligible_pieces" || r.URL.Query().Get("limit") != fmt.Sprint(eligiblePiecesLimit) {
+			t.Errorf("unexpected request: %s", r.URL)
+		}
+		// Cut short: 2 pieces listed, only 1 sent
+		w.Write([]byte(`{"response_code":200,"response_entries":2,"response":[{"piece_cid":"a","sources":[{"provider_id":"f01"}]}]}`))
+	}))
+	defer srv.Close()
+
+	deals, err := testEvergreenClient(srv.URL).QueryAvailableDeals(spid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deals.Decoded != 1 || deals.ResponseEntries != 2 {
+		t.Errorf("expected the short list to be returned as received, got %+v", deals)
+	}
+}
+
+func TestDecodeAvailableDealsNullResponse(t *testing.T) {
+	deals, err := DecodeAvailableDeals(strings.NewReader(`{"response_code": 401, "info_lines": ["bad auth"], "response": null}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deals.ResponseCode != 401 || len(deals.Response) != 0 {
+		t.Errorf("unexpected result: %+v", deals)
+	}
+}
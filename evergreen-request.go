@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	evergreenRetryBaseDelay     = 2 * time.Second
+	evergreenRetryMaxDelay      = 2 * time.Minute
+	evergreenMaxRetryAfterDelay = 15 * time.Minute
+)
+
+// Error returned by the Evergreen API, either through the HTTP status or the response_code in the body
+type APIError struct {
+	RequestID    string
+	HttpStatus   int
+	ResponseCode int64
+	InfoLines    []string
+
+	RetryAfter    time.Duration
+	HasRetryAfter bool // Whether RetryAfter was sent, as 0 means retry straight away
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("evergreen API error (http status %d, response_code %d, request_id %q)", e.HttpStatus, e.ResponseCode, e.RequestID)
+	if len(e.InfoLines) > 0 {
+		msg += ": " + strings.Join(e.InfoLines, "; ")
+	}
+	return msg
+}
+
+// Returns true if the request may succeed when retried later (rate limiting or server-side failures)
+func (e *APIError) Temporary() bool {
+	return isTransientStatus(int64(e.HttpStatus)) || isTransientStatus(e.ResponseCode)
+}
+
+func isTransientStatus(code int64) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusRequestTimeout || code >= 500
+}
+
+// Failure to reach Evergreen or to read its response, which may succeed when retried
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
+// Whether a request failed in a way worth retrying. Anything else, like failing to sign the FIL-SPID
+// header or a response that doesn't parse, would fail the same way again
+func isRetryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	var transportErr *transportError
+	return errors.As(err, &transportErr)
+}
+
+// Common fields present on every Evergreen API response
+type apiResponseHeader struct {
+	RequestID    string   `json:"request_id"`
+	ResponseCode int64    `json:"response_code"`
+	InfoLines    []string `json:"info_lines"`
+}
+
+// Performs an authenticated GET request against the Evergreen API, returning the response body
+// Transport failures and transient API errors are retried with jittered exponential backoff, honouring
+// any Retry-After header
+func (c *HttpEvergreenClient) get(spid address.Address, path string) ([]byte, error) {
+	var body []byte
+
+	err := c.getStream(spid, path, func(r io.Reader) (*apiResponseHeader, error) {
+		var err error
+		body, err = ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+
+		// Malformed bodies are left to the caller to report
+		var header apiResponseHeader
+		json.Unmarshal(body, &header)
+		return &header, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// Like get, but hands the successful response body to decode as a stream instead of buffering it
+// decode must return the common response fields, so response_code can be checked once the body is consumed
+func (c *HttpEvergreenClient) getStream(spid address.Address, path string, decode func(io.Reader) (*apiResponseHeader, error)) error {
+	var attempt uint = 0
+
+	for {
+		err := c.getOnce(spid, path, decode)
+		if err == nil {
+			return nil
+		}
+
+		if !isRetryable(err) || attempt >= c.maxRetries {
+			return err
+		}
+
+		delay := backoffDelay(attempt)
+		if apiErr, isApiErr := err.(*APIError); isApiErr && apiErr.HasRetryAfter {
+			delay = apiErr.RetryAfter
+		}
+		attempt++
+
+		log.Debugf("evergreen request %s failed, retrying in %v (attempt %d/%d): %s", path, delay, attempt, c.maxRetries, err)
+		time.Sleep(delay)
+	}
+}
+
+func (c *HttpEvergreenClient) getOnce(spid address.Address, path string, decode func(io.Reader) (*apiResponseHeader, error)) error {
+	req, err := http.NewRequest("GET", c.baseUrl+path, nil)
+	if err != nil {
+		return err
+	}
+
+	authCode, err := c.authHeader(spid)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", strings.TrimSuffix(authCode, "\n"))
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return &transportError{err: err}
+	}
+	defer resp.Body.Close()
+
+	// Don't keep sending a header Evergreen no longer accepts
+	if resp.StatusCode == http.StatusUnauthorized && c.rejectAuth != nil {
+		c.rejectAuth(spid, authCode)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Non-JSON bodies (ex: from a proxy) still produce an APIError, just without the Evergreen fields
+		var header apiResponseHeader
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		json.Unmarshal(body, &header)
+
+		return newAPIError(resp, &header)
+	}
+
+	header, err := decode(resp.Body)
+	if err != nil {
+		// The connection may have dropped or timed out part way through the body
+		var netErr net.Error
+		if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return &transportError{err: err}
+		}
+		return err
+	}
+
+	if header.ResponseCode != 0 && header.ResponseCode != http.StatusOK {
+		return newAPIError(resp, header)
+	}
+
+	return nil
+}
+
+func newAPIError(resp *http.Response, header *apiResponseHeader) *APIError {
+	retryAfter, hasRetryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+	return &APIError{
+		RequestID:     header.RequestID,
+		HttpStatus:    resp.StatusCode,
+		ResponseCode:  header.ResponseCode,
+		InfoLines:     header.InfoLines,
+		RetryAfter:    retryAfter,
+		HasRetryAfter: hasRetryAfter,
+	}
+}
+
+// Exponential backoff with full jitter: a random delay in [0, min(max, base * 2^attempt)]
+func backoffDelay(attempt uint) time.Duration {
+	ceiling := evergreenRetryMaxDelay
+	if attempt < 16 && evergreenRetryBaseDelay<<attempt < ceiling {
+		ceiling = evergreenRetryBaseDelay << attempt
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// Parses a Retry-After header, which is either a number of seconds or an HTTP date
+// Returns false if the header is missing or invalid
+func parseRetryAfter(value string) (time.Duration, bool) {
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		delay = time.Until(t)
+	} else {
+		return 0, false
+	}
+
+	if delay < 0 {
+		return 0, true
+	}
+	if delay > evergreenMaxRetryAfterDelay {
+		return evergreenMaxRetryAfterDelay, true
+	}
+	return delay, true
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+type filSPIDToken struct {
+	header    string
+	epoch     int64
+	refreshAt time.Time
+	expiresAt time.Time
+}
+
+// Caches signed FIL-SPID-V0 headers per SP, so all threads share one header per epoch window
+// Concurrent refreshes for the same SP are collapsed into a single signing round trip
+type FilSPIDTokenProvider struct {
+	mu     sync.RWMutex
+	tokens map[string]filSPIDToken
+	group  singleflight.Group
+
+	validEpochs        int64
+	refreshAheadEpochs int64
+	generate           func(spid address.Address, epoch int64) (string, error)
+}
+
+// Fails unless headers are refreshed some time before they expire
+func NewFilSPIDTokenProvider(signer FilSPIDSigner, cfg EvergreenDealbotConfig) (*FilSPIDTokenProvider, error) {
+	if cfg.Evergreen.AuthRefreshAheadEpochs >= cfg.Evergreen.AuthCacheEpochs {
+		return nil, fmt.Errorf("FIL_SPID_REFRESH_AHEAD_EPOCHS (%d) must be less than FIL_SPID_CACHE_EPOCHS (%d)",
+			cfg.Evergreen.AuthRefreshAheadEpochs, cfg.Evergreen.AuthCacheEpochs)
+	}
+
+	return &FilSPIDTokenProvider{
+		tokens:             make(map[string]filSPIDToken),
+		validEpochs:        int64(cfg.Evergreen.AuthCacheEpochs),
+		refreshAheadEpochs: int64(cfg.Evergreen.AuthRefreshAheadEpochs),
+		generate:           signer.SignFilSPID,
+	}, nil
+}
+
+// Returns a FIL-SPID-V0 authorization header for the SP
+// Cached headers are returned as-is, and a background refresh is started once they get close to expiry
+func (p *FilSPIDTokenProvider) Token(spid address.Address) (string, error) {
+	key := spid.String()
+
+	p.mu.RLock()
+	token, found := p.tokens[key]
+	p.mu.RUnlock()
+
+	now := time.Now()
+	if found && now.Before(token.expiresAt) {
+		if !now.Before(token.refreshAt) {
+			go func() {
+				if _, err := p.refresh(spid); err != nil {
+					log.Warnf("background FIL-SPID refresh failed: %s", err)
+				}
+			}()
+		}
+		return token.header, nil
+	}
+
+	return p.refresh(spid)
+}
+
+// Drops the cached header for the SP if it is still the cached header, ex: after Evergreen refused it
+// The next request signs a new one
+func (p *FilSPIDTokenProvider) Invalidate(spid address.Address, header string) {
+	key := spid.String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if token, found := p.tokens[key]; found && token.header == header {
+		log.Debugf("dropping the FIL-SPID token for %s from epoch %d", key, token.epoch)
+		delete(p.tokens, key)
+	}
+}
+
+func (p *FilSPIDTokenProvider) refresh(spid address.Address) (string, error) {
+	key := spid.String()
+
+	header, err, _ := p.group.Do(key, func() (interface{}, error) {
+		// Another caller may have refreshed the token while we were waiting
+		p.mu.RLock()
+		token, found := p.tokens[key]
+		p.mu.RUnlock()
+		if found && time.Now().Before(token.refreshAt) {
+			return token.header, nil
+		}
+
+		epoch := currentFilEpoch()
+		header, err := p.generate(spid, epoch)
+		if err != nil {
+			return "", err
+		}
+
+		token = filSPIDToken{
+			header:    header,
+			epoch:     epoch,
+			refreshAt: filEpochTime(epoch + p.validEpochs - p.refreshAheadEpochs),
+			expiresAt: filEpochTime(epoch + p.validEpochs),
+		}
+
+		p.mu.Lock()
+		p.tokens[key] = token
+		p.mu.Unlock()
+
+		log.Debugf("generated FIL-SPID token for %s at epoch %d, valid until %v", key, epoch, token.expiresAt)
+		return header, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return header.(string), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+)
+
+func TestFilSPIDTokenProviderSharesRefresh(t *testing.T) {
+	spid, _ := address.NewIDAddress(1234)
+	var calls int32
+
+	p := &FilSPIDTokenProvider{
+		tokens:             make(map[string]filSPIDToken),
+		validEpochs:        10,
+		refreshAheadEpochs: 2,
+		generate: func(spid address.Address, epoch int64) (string, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(50 * time.Millisecond)
+			return "FIL-SPID-V0 token", nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			header, err := p.Token(spid)
+			if err != nil || header != "FIL-SPID-V0 token" {
+				t.Errorf("unexpected token %q: %v", header, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := p.Token(spid); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected a single signing call, got %d", n)
+	}
+}
+
+func TestFilSPIDTokenProviderInvalidate(t *testing.T) {
+	spid, _ := address.NewIDAddress(1234)
+	var calls int32
+
+	p := &FilSPIDTokenProvider{
+		tokens:             make(map[string]filSPIDToken),
+		validEpochs:        10,
+		refreshAheadEpochs: 2,
+		generate: func(spid address.Address, epoch int64) (string, error) {
+			return fmt.Sprintf("FIL-SPID-V0 token %d", atomic.AddInt32(&calls, 1)), nil
+		},
+	}
+
+	first, _ := p.Token(spid)
+
+	// A header that has already been replaced is left alone
+	p.Invalidate(spid, "FIL-SPID-V0 stale")
+	if header, _ := p.Token(spid); header != first {
+		t.Errorf("expected the cached header to be kept, got %q", header)
+	}
+
+	p.Invalidate(spid, first)
+	if header, _ := p.Token(spid); header == first {
+		t.Error("expected a refused header to be signed again")
+	}
+}
+
+func TestFilSPIDTokenProviderRefreshesBeforeExpiry(t *testing.T) {
+	var cfg EvergreenDealbotConfig
+	cfg.Evergreen.AuthCacheEpochs = 2
+	cfg.Evergreen.AuthRefreshAheadEpochs = 2
+
+	if _, err := NewFilSPIDTokenProvider(nil, cfg); err == nil {
+		t.Error("expected refreshing no earlier than expiry to be rejected")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api/v1api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/wallet/key"
+	"github.com/filecoin-project/lotus/lib/sigs"
+	_ "github.com/filecoin-project/lotus/lib/sigs/bls"
+	_ "github.com/filecoin-project/lotus/lib/sigs/secp"
+)
+
+// Returns the random beacon entry for a Filecoin epoch
+type BeaconSource interface {
+	BeaconEntry(ctx context.Context, epoch int64) ([]byte, error)
+}
+
+// Signs FIL-SPID headers with a worker key loaded from disk, so the key never has to live on the chain node
+type LocalFilSPIDSigner struct {
+	key    *key.Key
+	beacon BeaconSource
+}
+
+// Loads the worker key from FIL_SPID_KEY_FILE, taking beacon entries from FIL_SPID_BEACON_URL if set, or the full node otherwise
+// Fails if the key isn't the SP's current worker key, as Evergreen would reject every header signed with it
+func NewLocalFilSPIDSigner(cfg EvergreenDealbotConfig) (*LocalFilSPIDSigner, error) {
+	k, err := LoadKeyInfoFile(cfg.Evergreen.FilSPIDKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkWorkerKeyFile(k.Address, cfg); err != nil {
+		return nil, err
+	}
+
+	var beacon BeaconSource = &LotusBeaconSource{fullNodeApiInfo: cfg.Lotus.FullNodeApiInfo}
+	if cfg.Evergreen.FilSPIDBeaconUrl != "" {
+		beacon = NewDrandBeaconSource(cfg.Evergreen.FilSPIDBeaconUrl, cfg.Evergreen.FilSPIDBeaconChain)
+	}
+
+	return &LocalFilSPIDSigner{key: k, beacon: beacon}, nil
+}
+
+func checkWorkerKeyFile(keyAddr address.Address, cfg EvergreenDealbotConfig) error {
+	spid, err := MinerActorAddress(cfg.Lotus.MinerApiInfo)
+	if err != nil {
+		return err
+	}
+
+	api, closer, err := LotusConnection(cfg.Lotus.FullNodeApiInfo)
+	if err != nil {
+		return fmt.Errorf("error creating lotus connection %s", err)
+	}
+	defer closer()
+
+	return checkWorkerKey(context.Background(), api, spid, keyAddr)
+}
+
+// Checks that keyAddr is the key address of the SP's worker
+func checkWorkerKey(ctx context.Context, api v1api.FullNode, spid address.Address, keyAddr address.Address) error {
+	info, err := api.StateMinerInfo(ctx, spid, types.EmptyTSK)
+	if err != nil {
+		return fmt.Errorf("getting miner info for %s: %s", spid, err)
+	}
+
+	worker, err := api.StateAccountKey(ctx, info.Worker, types.EmptyTSK)
+	if err != nil {
+		return fmt.Errorf("resolving worker key address: %s", err)
+	}
+
+	if worker != keyAddr {
+		return fmt.Errorf("FIL_SPID_KEY_FILE holds the key for %s, but the worker of %s is %s (%s)", keyAddr, spid, info.Worker, worker)
+	}
+	return nil
+}
+
+// Reads a key exported with `lotus wallet export`, which is hex-encoded KeyInfo JSON
+func LoadKeyInfoFile(path string) (*key.Key, error) {
+	if path == "" {
+		return nil, fmt.Errorf("FIL_SPID_KEY_FILE must be set to use the local signer")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %s", err)
+	}
+
+	return parseKeyInfo(data)
+}
+
+func parseKeyInfo(data []byte) (*key.Key, error) {
+	trimmed := strings.TrimSpace(string(data))
+
+	// Accept both the hex-encoded export format and plain KeyInfo JSON
+	kiJson := []byte(trimmed)
+	if decoded, err := hex.DecodeString(trimmed); err == nil {
+		kiJson = decoded
+	}
+
+	var ki types.KeyInfo
+	if err := json.Unmarshal(kiJson, &ki); err != nil {
+		return nil, fmt.Errorf("parsing key info: %s", err)
+	}
+
+	if ki.Type != types.KTSecp256k1 && ki.Type != types.KTBLS {
+		return nil, fmt.Errorf("unsupported key type %q, expected secp256k1 or bls", ki.Type)
+	}
+
+	return key.NewKey(ki)
+}
+
+// Address of the loaded worker key
+func (s *LocalFilSPIDSigner) Address() address.Address {
+	return s.key.Address
+}
+
+func (s *LocalFilSPIDSigner) SignFilSPID(spidAddr address.Address, epoch int64) (string, error) {
+	beacon, err := s.beacon.BeaconEntry(context.Background(), epoch)
+	if err != nil {
+		return "", fmt.Errorf("getting beacon entry for epoch %d: %s", epoch, err)
+	}
+
+	return s.signWithBeacon(spidAddr, epoch, beacon)
+}
+
+func (s *LocalFilSPIDSigner) signWithBeacon(spidAddr address.Address, epoch int64, beacon []byte) (string, error) {
+	msg, err := filSPIDMessage(beacon)
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := sigs.Sign(key.ActSigType(s.key.Type), s.key.PrivateKey, msg)
+	if err != nil {
+		return "", fmt.Errorf("signing FIL-SPID message: %s", err)
+	}
+
+	return formatFilSPID(epoch, spidAddr, sig), nil
+}
+
+// Reads beacon entries from chain state through the full node (read-only, no wallet access needed)
+type LotusBeaconSource struct {
+	fullNodeApiInfo string
+}
+
+func (b *LotusBeaconSource) BeaconEntry(ctx context.Context, epoch int64) ([]byte, error) {
+	api, closer, err := LotusConnection(b.fullNodeApiInfo)
+	defer closer()
+	if err != nil {
+		return nil, fmt.Errorf("error creating lotus connection %s", err)
+	}
+
+	entry, err := api.StateGetBeaconEntry(ctx, abi.ChainEpoch(epoch))
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.Data, nil
+}
+
+// Reads beacon entries straight from a drand HTTP relay, ex: https://api.drand.sh
+// The chain's genesis time and period are read from the relay's /info, so they follow the chain configured
+type DrandBeaconSource struct {
+	url    string // Including the chain hash, if one is configured
+	chain  string
+	client *http.Client
+
+	mu   sync.Mutex
+	info *drandChainInfo
+}
+
+// Reads from the chain with the given hash, or the relay's default chain if chain is empty
+func NewDrandBeaconSource(url string, chain string) *DrandBeaconSource {
+	url = strings.TrimSuffix(url, "/")
+	if chain != "" {
+		url += "/" + chain
+	}
+	return &DrandBeaconSource{url: url, chain: chain, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+type drandChainInfo struct {
+	Period      int64  `json:"period"`
+	GenesisTime int64  `json:"genesis_time"`
+	Hash        string `json:"hash"`
+}
+
+type drandPublicResponse struct {
+	Round     uint64 `json:"round"`
+	Signature string `json:"signature"`
+}
+
+func (b *DrandBeaconSource) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", b.url+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("drand returned status %d for %s", resp.StatusCode, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// The chain parameters, fetched the first time they're needed
+func (b *DrandBeaconSource) chainInfo(ctx context.Context) (drandChainInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.info != nil {
+		return *b.info, nil
+	}
+
+	var info drandChainInfo
+	if err := b.get(ctx, "/info", &info); err != nil {
+		return drandChainInfo{}, fmt.Errorf("getting drand chain info: %s", err)
+	}
+	if b.chain != "" && info.Hash != b.chain {
+		return drandChainInfo{}, fmt.Errorf("drand returned chain %s, expected %s", info.Hash, b.chain)
+	}
+	if info.Period <= 0 {
+		return drandChainInfo{}, fmt.Errorf("drand returned a period of %d seconds", info.Period)
+	}
+
+	b.info = &info
+	return info, nil
+}
+
+func (b *DrandBeaconSource) BeaconEntry(ctx context.Context, epoch int64) ([]byte, error) {
+	info, err := b.chainInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	round := drandRoundForEpoch(epoch, info.GenesisTime, info.Period)
+
+	var entry drandPublicResponse
+	if err := b.get(ctx, fmt.Sprintf("/public/%d", round), &entry); err != nil {
+		return nil, err
+	}
+
+	if entry.Round != round {
+		return nil, fmt.Errorf("drand returned round %d, expected %d", entry.Round, round)
+	}
+
+	return hex.DecodeString(entry.Signature)
+}
+
+// Maps a Filecoin epoch to the round Lotus uses for it on a drand chain (MaxBeaconRoundForEpoch, network version 16+)
+func drandRoundForEpoch(epoch int64, drandGenesisUnix int64, drandPeriod int64) uint64 {
+	latestTs := filGenesisUnix + (epoch-1)*int64(filEpochDuration.Seconds())
+	if latestTs < drandGenesisUnix {
+		return 1
+	}
+	return uint64((latestTs-drandGenesisUnix)/drandPeriod) + 1
+}
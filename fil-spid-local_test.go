@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/v1api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/wallet/key"
+	"github.com/filecoin-project/lotus/lib/sigs"
+)
+
+// secp256k1 key in `lotus wallet export` format, with the header Lotus WalletSign produces for it
+const (
+	testKeyInfoHex = "7b22507269766174654b6579223a227177754b313635526354613977703263765931697a344e736c4278672b586c45384b5377445647512f76733d222c2254797065223a22736563703235366b31227d"
+	testKeyAddress = "f1j6jc5hwpocbip73vw22xi3zp4krhey5g3ykl4nq"
+	testBeaconHex  = "f3c73a4e12337472747fab74e826c1376b91584de65c9a74b4be617cdcbeb0cdf3c73a4e12337472747fab74e826c1376b91584de65c9a74b4be617cdcbeb0cdf3c73a4e12337472747fab74e826c1376b91584de65c9a74b4be617cdcbeb0cd"
+	testEpoch      = 2205910
+	testSignature  = "EaHfszU39sGowM4U9EEVxF/YgvMl6aDXxrrhIH5/izRHqKO0BqgfmoCIcKzlDKLS7orqsRwxlFclqFL2BL8QTwE="
+)
+
+type staticBeaconSource []byte
+
+func (b staticBeaconSource) BeaconEntry(ctx context.Context, epoch int64) ([]byte, error) {
+	return b, nil
+}
+
+func TestLocalFilSPIDSignerMatchesLotus(t *testing.T) {
+	k, err := parseKeyInfo([]byte(testKeyInfoHex + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedAddr, _ := address.NewFromString(testKeyAddress)
+	if k.Address != expectedAddr {
+		t.Fatalf("unexpected key address %s", k.Address)
+	}
+
+	beacon, _ := hex.DecodeString(testBeaconHex)
+	spid, _ := address.NewIDAddress(1234)
+	signer := &LocalFilSPIDSigner{key: k, beacon: staticBeaconSource(beacon)}
+
+	header, err := signer.SignFilSPID(spid, testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "FIL-SPID-V0 2205910;" + spid.String() + ";1;" + testSignature
+	if header != expected {
+		t.Errorf("got %q, expected %q", header, expected)
+	}
+}
+
+func TestLocalFilSPIDSignerBLS(t *testing.T) {
+	k, err := key.GenerateKey(types.KTBLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	beacon, _ := hex.DecodeString(testBeaconHex)
+	spid, _ := address.NewIDAddress(1234)
+	signer := &LocalFilSPIDSigner{key: k, beacon: staticBeaconSource(beacon)}
+
+	header, err := signer.SignFilSPID(spid, testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(header, ";")
+	if len(parts) != 4 || parts[2] != "2" {
+		t.Fatalf("malformed BLS header %q", header)
+	}
+
+	sigData, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, _ := filSPIDMessage(beacon)
+	sig := &crypto.Signature{Type: crypto.SigTypeBLS, Data: sigData}
+	if err := sigs.Verify(sig, k.Address, msg); err != nil {
+		t.Errorf("BLS FIL-SPID signature does not verify: %s", err)
+	}
+}
+
+// Serves one beacon entry from a drand chain with the given parameters, under /<chain>
+func testDrandServer(t *testing.T, chain string, genesis int64, period int64, round uint64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + chain + "/info":
+			fmt.Fprintf(w, `{"period":%d,"genesis_time":%d,"hash":%q}`, period, genesis, chain)
+		case fmt.Sprintf("/%s/public/%d", chain, round):
+			fmt.Fprintf(w, `{"round":%d,"signature":%q}`, round, testBeaconHex)
+		default:
+			t.Errorf("unexpected drand request: %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestDrandBeaconSource(t *testing.T) {
+	// The chain Filecoin used before quicknet, with 30 second rounds
+	srv := testDrandServer(t, "8990e7a9", 1595431050, 30, 2301755)
+	defer srv.Close()
+
+	b := NewDrandBeaconSource(srv.URL+"/", "8990e7a9")
+	entry, err := b.BeaconEntry(context.Background(), testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hex.EncodeToString(entry) != testBeaconHex {
+		t.Errorf("unexpected beacon entry %x", entry)
+	}
+}
+
+func TestDrandBeaconSourceQuicknet(t *testing.T) {
+	// Quicknet has 3 second rounds, and started long after Filecoin
+	srv := testDrandServer(t, "52db9ba7", 1692803367, 3, 10501002)
+	defer srv.Close()
+
+	b := NewDrandBeaconSource(srv.URL, "52db9ba7")
+	if _, err := b.BeaconEntry(context.Background(), 4200000); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDrandBeaconSourceWrongChain(t *testing.T) {
+	// A relay that answers for another chain than the one asked for
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"period":3,"genesis_time":1692803367,"hash":"52db9ba7"}`)
+	}))
+	defer srv.Close()
+
+	b := NewDrandBeaconSource(srv.URL, "8990e7a9")
+	if _, err := b.BeaconEntry(context.Background(), 4200000); err == nil {
+		t.Error("expected entries from another chain to be refused")
+	}
+}
+
+// Answers the miner info and key lookups for a single SP. Calling anything else panics
+type workerInfoNode struct {
+	v1api.FullNode
+
+	worker    address.Address
+	workerKey address.Address
+}
+
+func (n *workerInfoNode) StateMinerInfo(ctx context.Context, actor address.Address, tsk types.TipSetKey) (api.MinerInfo, error) {
+	return api.MinerInfo{Worker: n.worker}, nil
+}
+
+func (n *workerInfoNode) StateAccountKey(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	if addr != n.worker {
+		return address.Undef, fmt.Errorf("unknown actor %s", addr)
+	}
+	return n.workerKey, nil
+}
+
+func TestCheckWorkerKey(t *testing.T) {
+	k, err := parseKeyInfo([]byte(testKeyInfoHex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := key.GenerateKey(types.KTSecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spid, _ := address.NewIDAddress(1234)
+	worker, _ := address.NewIDAddress(5678)
+
+	node := &workerInfoNode{worker: worker, workerKey: k.Address}
+	if err := checkWorkerKey(context.Background(), node, spid, k.Address); err != nil {
+		t.Errorf("expected the worker key to be accepted, got %s", err)
+	}
+	if err := checkWorkerKey(context.Background(), node, spid, other.Address); err == nil {
+		t.Error("expected a key that isn't the worker's to be refused")
+	}
+}
@@ -8,17 +8,71 @@ import (
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
+	lapi "github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/chain/types"
 )
 
-// Generates a FIL SPID auth token for use with Evergreen APIs
+const (
+	filGenesisUnix   int64 = 1598306400
+	filEpochDuration       = 30 * time.Second
+
+	filAuthAddr = "FIL-SPID-V0"
+	b64SpacePad = "ICAg" // use this to pefix the random beacon, lest it becomes valid CBOR
+)
+
+// Returns the current Filecoin chain epoch, based on wall clock time
+func currentFilEpoch() int64 {
+	return (time.Now().Unix() - 1 - filGenesisUnix) / int64(filEpochDuration.Seconds())
+}
+
+// Returns the wall clock time at which the given epoch starts
+func filEpochTime(epoch int64) time.Time {
+	return time.Unix(filGenesisUnix+epoch*int64(filEpochDuration.Seconds()), 0)
+}
+
+// Produces FIL-SPID-V0 auth headers for an SP at a given epoch
+type FilSPIDSigner interface {
+	SignFilSPID(spidAddr address.Address, epoch int64) (string, error)
+}
+
+// Picks the signer backend configured with FIL_SPID_SIGNER
+func NewFilSPIDSigner(cfg EvergreenDealbotConfig) (FilSPIDSigner, error) {
+	switch cfg.Evergreen.FilSPIDSigner {
+	case "", "lotus":
+		return &LotusFilSPIDSigner{cfg: cfg}, nil
+	case "local":
+		return NewLocalFilSPIDSigner(cfg)
+	default:
+		return nil, fmt.Errorf("unknown FIL_SPID_SIGNER %q, expected lotus or local", cfg.Evergreen.FilSPIDSigner)
+	}
+}
+
+// Space Pad and DRAND must be appended as Base64, then converted back to []byte before being signed
+func filSPIDMessage(beacon []byte) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(b64SpacePad + base64.StdEncoding.EncodeToString(beacon))
+}
+
+func formatFilSPID(epoch int64, spidAddr address.Address, sig *crypto.Signature) string {
+	encodedSig := base64.StdEncoding.EncodeToString(sig.Data)
+	return fmt.Sprintf("%v %v;%v;%v;%v", filAuthAddr, epoch, spidAddr, sig.Type, encodedSig)
+}
+
+// Signs FIL-SPID headers with the SP worker key held in the full node wallet,
+// or in a separate wallet endpoint if WALLET_API_INFO is set
+type LotusFilSPIDSigner struct {
+	cfg EvergreenDealbotConfig
+}
+
+func (s *LotusFilSPIDSigner) SignFilSPID(spidAddr address.Address, epoch int64) (string, error) {
+	return evergreenFilSPIDAtEpoch(spidAddr, epoch, s.cfg)
+}
+
+// Generates a FIL SPID auth token for use with Evergreen APIs, signed at the given epoch
 // Based on fil-spid.bash
 // https://github.com/filecoin-project/evergreen-dealer/blob/master/misc/fil-spid.bash
 // Example FIL-SPID-V0 2205910;f012345;2;jKxW4olDvm+y+03uPyW+7ugoZ1tO6Bh3zdHF6B13tYUBV+c8uzmqJVfk5IK77CHrE/oRwBpizgsohdMQuFvflz9YMOYcTZ/zAeTUyswpwQ+/k011LL07PpjRE4fqniRI
-func evergreenFilSPID(spidAddr address.Address, cfg EvergreenDealbotConfig) (string, error) {
-	filAuthAddr := "FIL-SPID-V0"
-	var filGenesisUnix int64 = 1598306400
-	nowUnix := time.Now().Unix()
+func evergreenFilSPIDAtEpoch(spidAddr address.Address, filCurrentEpoch int64, cfg EvergreenDealbotConfig) (string, error) {
 	ctx := context.Background()
 
 	api, closer, err := LotusConnection(cfg.Lotus.FullNodeApiInfo)
@@ -27,9 +81,6 @@ func evergreenFilSPID(spidAddr address.Address, cfg EvergreenDealbotConfig) (str
 		return "", fmt.Errorf("error creating lotus connection %s", err)
 	}
 
-	b64SpacePad := "ICAg" // use this to pefix the random beacon, lest it becomes valid CBOR
-	filCurrentEpoch := (nowUnix - 1 - filGenesisUnix) / 30
-
 	filFinalizedTipset, err := api.ChainGetTipSetByHeight(ctx, abi.ChainEpoch(filCurrentEpoch-900), types.NewTipSetKey())
 	if err != nil {
 		return "", err
@@ -46,20 +97,45 @@ func evergreenFilSPID(spidAddr address.Address, cfg EvergreenDealbotConfig) (str
 		return "", err
 	}
 
-	// Space Pad and DRAND must be appended as Base64, then converted back to []byte before being signed
-	messgeToSign, err := base64.StdEncoding.DecodeString(b64SpacePad + base64.StdEncoding.EncodeToString(filCurrentDrandB64.Data))
+	messgeToSign, err := filSPIDMessage(filCurrentDrandB64.Data)
 	if err != nil {
 		return "", err
 	}
 
-	filAuthSig, err := api.WalletSign(ctx, filFinalizedWorkerId.Worker, messgeToSign)
-	if err != nil {
-		return "", err
+	var filAuthSig *crypto.Signature
+	if cfg.Lotus.WalletApiInfo != "" {
+		// The remote wallet only knows key addresses, so resolve the worker ID through chain state first
+		workerKey, err := api.StateAccountKey(ctx, filFinalizedWorkerId.Worker, finalizedTsk)
+		if err != nil {
+			return "", fmt.Errorf("resolving worker key address: %s", err)
+		}
+
+		filAuthSig, err = remoteWalletSign(ctx, cfg.Lotus.WalletApiInfo, workerKey, messgeToSign)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		filAuthSig, err = api.WalletSign(ctx, filFinalizedWorkerId.Worker, messgeToSign)
+		if err != nil {
+			return "", err
+		}
 	}
 
-	encodedSig := base64.StdEncoding.EncodeToString(filAuthSig.Data)
+	return formatFilSPID(filCurrentEpoch, spidAddr, filAuthSig), nil
+}
 
-	result := fmt.Sprintf("%v %v;%v;%v;%v", filAuthAddr, filCurrentEpoch, spidAddr, filAuthSig.Type, encodedSig)
+// Signs the FIL-SPID message through a dedicated wallet endpoint (WALLET_API_INFO), instead of the full node
+func remoteWalletSign(ctx context.Context, walletApiInfo string, signer address.Address, msg []byte) (*crypto.Signature, error) {
+	wallet, closer, err := WalletConnection(walletApiInfo)
+	if err != nil {
+		return nil, fmt.Errorf("error creating wallet connection %s", err)
+	}
+	defer closer()
+
+	sig, err := wallet.WalletSign(ctx, signer, msg, lapi.MsgMeta{Type: lapi.MTUnknown})
+	if err != nil {
+		return nil, fmt.Errorf("remote wallet sign failed: %s", err)
+	}
 
-	return result, nil
+	return sig, nil
 }
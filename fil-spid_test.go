@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/crypto"
+	lapi "github.com/filecoin-project/lotus/api"
+)
+
+type fakeWallet struct {
+	signer address.Address
+	msg    []byte
+}
+
+func (w *fakeWallet) WalletSign(ctx context.Context, signer address.Address, toSign []byte, meta lapi.MsgMeta) (*crypto.Signature, error) {
+	w.signer = signer
+	w.msg = toSign
+	return &crypto.Signature{Type: crypto.SigTypeSecp256k1, Data: []byte("signature")}, nil
+}
+
+func TestRemoteWalletSign(t *testing.T) {
+	wallet := &fakeWallet{}
+	rpcServer := jsonrpc.NewServer()
+	rpcServer.Register("Filecoin", wallet)
+
+	var authHeader string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rpc/v0", func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+		rpcServer.ServeHTTP(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	hostPort := strings.Split(strings.TrimPrefix(srv.URL, "http://"), ":")
+	walletApiInfo := "signtoken:/ip4/" + hostPort[0] + "/tcp/" + hostPort[1] + "/http"
+
+	worker, _ := address.NewIDAddress(5678)
+	msg, _ := filSPIDMessage([]byte("beacon"))
+
+	sig, err := remoteWalletSign(context.Background(), walletApiInfo, worker, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(sig.Data) != "signature" || sig.Type != crypto.SigTypeSecp256k1 {
+		t.Errorf("unexpected signature %+v", sig)
+	}
+	if wallet.signer != worker || string(wallet.msg) != string(msg) {
+		t.Errorf("wallet received unexpected sign request: %s %x", wallet.signer, wallet.msg)
+	}
+	if authHeader != "Bearer signtoken" {
+		t.Errorf("unexpected authorization header %q", authHeader)
+	}
+}
+
+func TestFormatFilSPID(t *testing.T) {
+	spid, _ := address.NewIDAddress(12345)
+	sig := &crypto.Signature{Type: crypto.SigTypeBLS, Data: []byte{1, 2, 3}}
+
+	expected := "FIL-SPID-V0 2205910;" + spid.String() + ";2;AQID"
+	if got := formatFilSPID(2205910, spid, sig); got != expected {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
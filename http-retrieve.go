@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/boost/retrievalmarket/lp2pimpl"
+	"github.com/filecoin-project/boost/retrievalmarket/types"
+	"github.com/filecoin-project/go-address"
+	multiaddrutil "github.com/filecoin-project/go-legs/httpsync/multiaddr"
+	"github.com/filecoin-project/go-state-types/big"
+	ltypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long a looked up HTTP transport (or the lack of one) is remembered for an SP
+const httpTransportCacheTTL = time.Hour
+
+type httpTransport struct {
+	url       *url.URL // nil if the SP doesn't serve pieces over HTTP
+	fetchedAt time.Time
+}
+
+var httpTransportsMu sync.Mutex
+var httpTransports = make(map[string]httpTransport)
+
+// Retrieves pieces over HTTP from Boost SPs, writing the raw piece data to dest
+// Fails if the SP doesn't advertise an HTTP transport
+type httpRetrievalBackend struct {
+	cfg EvergreenDealbotConfig
+}
+
+func (b *httpRetrievalBackend) Name() string {
+	return "http"
+}
+
+// booster-http doesn't charge for retrievals, so any SP with an HTTP transport makes a free offer
+func (b *httpRetrievalBackend) Query(ctx context.Context, pieceCid string, payloadCid string, pieceSize int64, source Source) (RetrievalOffer, error) {
+	if _, err := LookupHttpTransport(ctx, source.ProviderID, b.cfg); err != nil {
+		return RetrievalOffer{}, err
+	}
+	return RetrievalOffer{Price: big.Zero()}, nil
+}
+
+func (b *httpRetrievalBackend) Retrieve(ctx context.Context, pieceCid string, payloadCid string, pieceSize int64, source Source, dest string, progress RetrievalProgress) error {
+	baseUrl, err := LookupHttpTransport(ctx, source.ProviderID, b.cfg)
+	if err != nil {
+		return err
+	}
+
+	stallTimeout := time.Duration(b.cfg.Lotus.RetrievalTimeout) * time.Minute
+	client := &http.Client{Transport: http.DefaultTransport}
+
+	partial, release := claimPartial(dest, pieceCid)
+	defer release()
+
+	start := time.Now()
+	return DownloadPieceHttp(ctx, client, baseUrl, pieceCid, dest, partial, stallTimeout, func(received int64, total int64) {
+		log.Debugf("Recv %s of %s over http from %s, %s",
+			ltypes.SizeStr(ltypes.NewInt(uint64(received))),
+			ltypes.SizeStr(ltypes.NewInt(uint64(total))),
+			source.ProviderID,
+			time.Since(start).Truncate(time.Millisecond),
+		)
+		progress(received, total)
+	})
+}
+
+// Returns the base URL the SP serves pieces on, querying its retrieval transports over libp2p
+// Results are cached, so SPs without HTTP retrieval are not queried again for every piece
+func LookupHttpTransport(ctx context.Context, sp string, cfg EvergreenDealbotConfig) (*url.URL, error) {
+	httpTransportsMu.Lock()
+	cached, found := httpTransports[sp]
+	httpTransportsMu.Unlock()
+
+	if !found || time.Since(cached.fetchedAt) > httpTransportCacheTTL {
+		transports, err := queryRetrievalTransports(ctx, sp, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		cached = httpTransport{fetchedAt: time.Now()}
+		cached.url, err = httpTransportUrl(transports)
+		if err != nil {
+			log.Debugf("no http transport for %s: %s", sp, err)
+		}
+
+		httpTransportsMu.Lock()
+		httpTransports[sp] = cached
+		httpTransportsMu.Unlock()
+	}
+
+	if cached.url == nil {
+		return nil, fmt.Errorf("SP %s does not support http retrieval", sp)
+	}
+	return cached.url, nil
+}
+
+// Asks the SP which retrieval transports it supports, using the peer info it has on chain
+func queryRetrievalTransports(ctx context.Context, sp string, cfg EvergreenDealbotConfig) (*types.QueryResponse, error) {
+	minerAddr, err := address.NewFromString(sp)
+	if err != nil {
+		return nil, err
+	}
+
+	api, closer, err := LotusConnection(cfg.Lotus.FullNodeApiInfo)
+	if err != nil {
+		return nil, fmt.Errorf("error creating lotus connection %s", err)
+	}
+	defer closer()
+
+	minerInfo, err := api.StateMinerInfo(ctx, minerAddr, ltypes.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+	if minerInfo.PeerId == nil {
+		return nil, fmt.Errorf("SP %s has no peer ID set on chain", sp)
+	}
+
+	addrInfo := peer.AddrInfo{ID: *minerInfo.PeerId}
+	for _, b := range minerInfo.Multiaddrs {
+		ma, err := multiaddr.NewMultiaddrBytes(b)
+		if err != nil {
+			return nil, fmt.Errorf("SP %s has invalid multiaddrs on chain: %s", sp, err)
+		}
+		addrInfo.Addrs = append(addrInfo.Addrs, ma)
+	}
+	if len(addrInfo.Addrs) == 0 {
+		return nil, fmt.Errorf("SP %s has no multiaddrs set on chain", sp)
+	}
+
+	// Short-lived host, only used to dial out for the query
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	if err := h.Connect(ctx, addrInfo); err != nil {
+		return nil, fmt.Errorf("failed to connect to SP %s: %s", sp, err)
+	}
+
+	return lp2pimpl.NewTransportsClient(h).SendQuery(ctx, addrInfo.ID)
+}
+
+// Picks the first HTTP(S) address out of an SP's advertised retrieval transports
+func httpTransportUrl(transports *types.QueryResponse) (*url.URL, error) {
+	for _, protocol := range transports.Protocols {
+		if protocol.Name != "http" && protocol.Name != "https" {
+			continue
+		}
+
+		for _, ma := range protocol.Addresses {
+			u, err := multiaddrutil.ToURL(ma)
+			if err != nil {
+				log.Debugf("skipping http transport address %s: %s", ma, err)
+				continue
+			}
+			return u, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no http transport advertised")
+}
+
+// Downloads a piece from a booster-http endpoint to dest
+// Data goes to the partial file first, which is resumed with a Range request if an earlier attempt left one.
+// It is moved to dest once complete, and kept along with its progress if the download fails
+// The download is abandoned if no data is received for stallTimeout
+// progress is called every 10 seconds, and once the download completes, with the bytes received so far
+// and the total size if known (or -1)
+func DownloadPieceHttp(ctx context.Context, client *http.Client, baseUrl *url.URL, pieceCid string, dest string, partial string, stallTimeout time.Duration, progress RetrievalProgress) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	state := loadPartial(partial, pieceCid)
+	state.Source = baseUrl.Host
+
+	pieceUrl := strings.TrimSuffix(baseUrl.String(), "/") + "/piece/" + pieceCid
+	req, err := http.NewRequestWithContext(ctx, "GET", pieceUrl, nil)
+	if err != nil {
+		return err
+	}
+	if state.Offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", state.Offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && state.Offset > 0:
+		start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != state.Offset {
+			return fmt.Errorf("http retrieval of %s returned an unexpected range %q", pieceCid, resp.Header.Get("Content-Range"))
+		}
+		log.Debugf("resuming http retrieval of %s from byte %d", pieceCid, state.Offset)
+		state.Total = total
+	case resp.StatusCode == http.StatusOK:
+		// Nothing to resume, or the SP ignored the range and is sending the whole piece
+		state.Offset = 0
+		state.Total = resp.ContentLength
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && state.Offset > 0:
+		// The partial can't be continued from here, start over next time
+		removePartial(partial)
+		return fmt.Errorf("http retrieval of %s can't resume from byte %d", pieceCid, state.Offset)
+	default:
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("http retrieval of %s failed with status %d: %s", pieceCid, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(state.Offset); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(state.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	resumedFrom := state.Offset
+	w := &partialWriter{f: f, path: partial, state: &state, savedAt: time.Now()}
+	body := &progressReader{r: resp.Body, lastRead: time.Now()}
+	done := make(chan struct{})
+	var stalled int32
+
+	// Report progress, and cancel the request if it stops sending data
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				received, lastRead := body.stats()
+				if stallTimeout > 0 && time.Since(lastRead) > stallTimeout {
+					atomic.StoreInt32(&stalled, 1)
+					cancel()
+					return
+				}
+				progress(resumedFrom+received, state.Total)
+			}
+		}
+	}()
+
+	_, err = io.Copy(w, body)
+	close(done)
+
+	// Keep whatever made it to disk for the next attempt
+	checkpointErr := w.checkpoint()
+	closeErr := f.Close()
+	if err == nil {
+		err = checkpointErr
+	}
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if atomic.LoadInt32(&stalled) == 1 {
+			return fmt.Errorf("http retrieval of %s stalled at byte %d: %w, no data for %v", pieceCid, state.Offset, errRetrievalTimeout, stallTimeout)
+		}
+		return fmt.Errorf("http retrieval of %s failed at byte %d: %s", pieceCid, state.Offset, err)
+	}
+
+	if state.Total >= 0 && state.Offset != state.Total {
+		if state.Offset > state.Total {
+			removePartial(partial)
+		}
+		return fmt.Errorf("http retrieval of %s ended early: got %d of %d bytes", pieceCid, state.Offset, state.Total)
+	}
+
+	if err := os.Rename(partial, dest); err != nil {
+		return err
+	}
+	os.Remove(partialMetaPath(partial))
+
+	progress(state.Offset, state.Total)
+	return nil
+}
+
+// Parses a "bytes <start>-<end>/<total>" Content-Range header. total is -1 if the server sent "*"
+func parseContentRange(header string) (start int64, total int64, err error) {
+	var end int64
+	var totalStr string
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%s", &start, &end, &totalStr); err != nil {
+		return 0, 0, err
+	}
+
+	if totalStr == "*" {
+		return start, -1, nil
+	}
+	if _, err := fmt.Sscanf(totalStr, "%d", &total); err != nil {
+		return 0, 0, err
+	}
+	return start, total, nil
+}
+
+// Counts the bytes read, and when data last came in
+type progressReader struct {
+	r io.Reader
+
+	mu       sync.Mutex
+	received int64
+	lastRead time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.mu.Lock()
+		p.received += int64(n)
+		p.lastRead = time.Now()
+		p.mu.Unlock()
+	}
+	return n, err
+}
+
+func (p *progressReader) stats() (int64, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.received, p.lastRead
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/boost/retrievalmarket/types"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const testPieceCid = "baga6ea4seaqao7s73y24kcutaosvacpdjgfe5pw76ooefnyqw4ynr3d2y6x2mpq"
+
+func testPieceServer(t *testing.T, handler http.HandlerFunc) *url.URL {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestDownloadPieceHttp(t *testing.T) {
+	piece := bytes.Repeat([]byte("evergreen"), 10000)
+
+	baseUrl := testPieceServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/piece/"+testPieceCid {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(piece))
+	})
+
+	dest := filepath.Join(t.TempDir(), testPieceCid+".car")
+	var lastReceived, lastTotal int64
+	err := DownloadPieceHttp(context.Background(), http.DefaultClient, baseUrl, testPieceCid, dest, dest+".part", time.Minute, func(received int64, total int64) {
+		lastReceived, lastTotal = received, total
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, piece) {
+		t.Errorf("downloaded %d bytes, expected the %d byte piece", len(written), len(piece))
+	}
+	if lastReceived != int64(len(piece)) || lastTotal != int64(len(piece)) {
+		t.Errorf("expected final progress %d/%d, got %d/%d", len(piece), len(piece), lastReceived, lastTotal)
+	}
+}
+
+func TestDownloadPieceHttpErrors(t *testing.T) {
+	baseUrl := testPieceServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/piece/"+testPieceCid {
+			// Claims more data than it sends
+			w.Header().Set("Content-Length", "1000")
+			w.Write([]byte("short"))
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	dir := t.TempDir()
+	noProgress := func(int64, int64) {}
+
+	missing := filepath.Join(dir, "missing.car")
+	err := DownloadPieceHttp(context.Background(), http.DefaultClient, baseUrl, "missing", missing, missing+".part", time.Minute, noProgress)
+	if err == nil {
+		t.Error("expected an error for a piece the SP doesn't have")
+	}
+
+	dest := filepath.Join(dir, testPieceCid+".car")
+	err = DownloadPieceHttp(context.Background(), http.DefaultClient, baseUrl, testPieceCid, dest, dest+".part", time.Minute, noProgress)
+	if err == nil {
+		t.Error("expected an error for a truncated download")
+	}
+	if FileExists(dest) {
+		t.Error("truncated download should not be moved to dest")
+	}
+	if p := loadPartial(dest+".part", testPieceCid); p.Offset != 5 || p.Total != 1000 {
+		t.Errorf("expected the partial to be kept at 5 of 1000 bytes, got %d of %d", p.Offset, p.Total)
+	}
+}
+
+func TestDownloadPieceHttpResume(t *testing.T) {
+	piece := bytes.Repeat([]byte("evergreen"), 10000)
+
+	var ranges []string
+	ignoreRange := false
+	baseUrl := testPieceServer(t, func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(piece))
+	})
+
+	for _, ignore := range []bool{false, true} {
+		ignoreRange = ignore
+		ranges = nil
+
+		dir := t.TempDir()
+		dest := filepath.Join(dir, testPieceCid+".car")
+		partial := partialPath(dir, testPieceCid)
+
+		// An earlier attempt got the first 1000 bytes, and some garbage that never made it into the progress
+		written := append(append([]byte{}, piece[:1000]...), []byte("garbage")...)
+		if err := ioutil.WriteFile(partial, written, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := savePartial(partial, partialDownload{PieceCid: testPieceCid, Offset: 1000, Total: int64(len(piece))}); err != nil {
+			t.Fatal(err)
+		}
+
+		err := DownloadPieceHttp(context.Background(), http.DefaultClient, baseUrl, testPieceCid, dest, partial, time.Minute, func(int64, int64) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ranges) != 1 || ranges[0] != "bytes=1000-" {
+			t.Errorf("expected a single request resuming from byte 1000, got %q", ranges)
+		}
+		data, _ := ioutil.ReadFile(dest)
+		if !bytes.Equal(data, piece) {
+			t.Errorf("ignoreRange=%v: resumed download doesn't match the piece", ignore)
+		}
+		if FileExists(partial) || FileExists(partialMetaPath(partial)) {
+			t.Error("partial should be cleaned up once complete")
+		}
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, total, err := parseContentRange("bytes 1000-89999/90000")
+	if err != nil || start != 1000 || total != 90000 {
+		t.Errorf("got %d, %d, %v", start, total, err)
+	}
+
+	start, total, err = parseContentRange("bytes 5-9/*")
+	if err != nil || start != 5 || total != -1 {
+		t.Errorf("got %d, %d, %v", start, total, err)
+	}
+
+	if _, _, err := parseContentRange("bytes */90000"); err == nil {
+		t.Error("expected an unsatisfied range to be rejected")
+	}
+}
+
+func TestHttpTransportUrl(t *testing.T) {
+	libp2pAddr, _ := multiaddr.NewMultiaddr("/ip4/1.2.3.4/tcp/24001")
+	httpAddr, _ := multiaddr.NewMultiaddr("/dns/sp.example.com/tcp/443/https")
+
+	u, err := httpTransportUrl(&types.QueryResponse{Protocols: []types.Protocol{
+		{Name: "libp2p", Addresses: []multiaddr.Multiaddr{libp2pAddr}},
+		{Name: "http", Addresses: []multiaddr.Multiaddr{httpAddr}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.String() != "https://sp.example.com:443" {
+		t.Errorf("unexpected url %s", u)
+	}
+
+	if _, err := httpTransportUrl(&types.QueryResponse{Protocols: []types.Protocol{
+		{Name: "libp2p", Addresses: []multiaddr.Multiaddr{libp2pAddr}},
+	}}); err == nil {
+		t.Error("expected an error when no http transport is advertised")
+	}
+}
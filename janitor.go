@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	lapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/v1api"
+	log "github.com/sirupsen/logrus"
+)
+
+// What a janitor run did
+type janitorReport struct {
+	At                 time.Time
+	RestartedTransfers int
+	StalledCancelled   int
+	AbandonedCancelled int
+	FilesRemoved       int
+}
+
+func (r janitorReport) String() string {
+	return fmt.Sprintf("restarted %d stalled transfers, cancelled %d stalled and %d abandoned retrievals, removed %d leftover files",
+		r.RestartedTransfers, r.StalledCancelled, r.AbandonedCancelled, r.FilesRemoved)
+}
+
+func (r janitorReport) empty() bool {
+	return r.RestartedTransfers+r.StalledCancelled+r.AbandonedCancelled+r.FilesRemoved == 0
+}
+
+// Last progress seen for a retrieval the dealbot started
+type transferProgress struct {
+	bytes     uint64
+	since     time.Time
+	restarted bool
+}
+
+// Periodically restarts, then cancels, dealbot retrievals that have stopped making progress, and removes
+// downloads no job will pick up again. Retrievals and transfers started by anything else are left alone
+type transferJanitor struct {
+	mu sync.Mutex
+
+	progress map[string]*transferProgress // By deal ID
+	last     janitorReport
+}
+
+var janitor = &transferJanitor{progress: make(map[string]*transferProgress)}
+
+// Runs the janitor at startup, to clean up after a previous run, then every JANITOR_INTERVAL_MINUTES
+func JanitorThread(cfg EvergreenDealbotConfig) {
+	interval := time.Duration(cfg.Common.JanitorInterval) * time.Minute
+
+	for {
+		report := janitor.run(cfg)
+		if !report.empty() {
+			log.Infof("janitor: %s", report)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func (j *transferJanitor) run(cfg EvergreenDealbotConfig) janitorReport {
+	report := janitorReport{At: time.Now()}
+
+	if owned := ownedRetrievals.all(); len(owned) > 0 {
+		api, closer, err := LotusConnection(cfg.Lotus.FullNodeApiInfo)
+		if err != nil {
+			log.Errorf("janitor: error creating lotus connection %s", err)
+		} else {
+			stall := time.Duration(cfg.Lotus.TransferStallTimeout) * time.Minute
+			report.RestartedTransfers, report.StalledCancelled = j.checkTransfers(api, owned, stall, time.Now())
+			closer()
+		}
+	}
+
+	cancelled, err := CleanupOwnedRetrievals(cfg)
+	if err != nil {
+		log.Errorf("janitor: cleaning up retrievals: %s", err)
+	}
+	report.AbandonedCancelled = cancelled
+
+	active := make(map[string]bool)
+	for _, job := range activeJobs.list() {
+		active[job.PieceCid] = true
+	}
+	report.FilesRemoved = CleanupOrphanedDownloads(cfg.Common.CarLocationDownload, active) +
+		CleanupStalePartials(cfg.Common.CarLocationDownload, time.Duration(cfg.Common.PartialMaxAge)*time.Hour)
+
+	j.mu.Lock()
+	j.last = report
+	j.mu.Unlock()
+	return report
+}
+
+// The report of the last run, if there has been one
+func (j *transferJanitor) lastReport() (janitorReport, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.last, !j.last.At.IsZero()
+}
+
+func channelEnded(status datatransfer.Status) bool {
+	switch status {
+	case datatransfer.Completing, datatransfer.Completed, datatransfer.Failing, datatransfer.Failed,
+		datatransfer.Cancelling, datatransfer.Cancelled, datatransfer.ChannelNotFoundError:
+		return true
+	}
+	return false
+}
+
+// Looks for owned retrievals that haven't received anything for stall. The first time, their transfers
+// are restarted. If they stall again they are cancelled. Returns the number of each
+func (j *transferJanitor) checkTransfers(api v1api.FullNode, owned []retrievalHandle, stall time.Duration, now time.Time) (int, int) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	retrievals, err := api.ClientListRetrievals(ctx)
+	if err != nil {
+		log.Errorf("janitor: listing retrievals failed: %s", err)
+		return 0, 0
+	}
+	transfers, err := api.ClientListDataTransfers(ctx)
+	if err != nil {
+		log.Errorf("janitor: listing transfers failed: %s", err)
+		return 0, 0
+	}
+
+	byDeal := make(map[retrievalmarket.DealID]lapi.RetrievalInfo)
+	for _, r := range retrievals {
+		byDeal[r.ID] = r
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	restarted, cancelled := 0, 0
+	seen := make(map[string]bool)
+	for _, h := range owned {
+		key := dealKey(h.DealID)
+
+		info, found := byDeal[h.DealID]
+		if !found || retrievalmarket.IsTerminalStatus(info.Status) {
+			continue
+		}
+		h.addChannel(info.TransferChannelID)
+		seen[key] = true
+
+		// Channels of this retrieval that are still open, and everything received so far
+		bytes := info.BytesReceived
+		var open []lapi.DataTransferChannel
+		for _, chid := range h.Channels {
+			otherPeer, isInitiator := h.channelPeer(chid)
+			for _, xfer := range transfers {
+				if xfer.TransferID == chid.ID && xfer.OtherPeer == otherPeer && xfer.IsInitiator == isInitiator {
+					bytes += xfer.Transferred
+					if !channelEnded(xfer.Status) {
+						open = append(open, xfer)
+					}
+				}
+			}
+		}
+
+		p, found := j.progress[key]
+		if !found || bytes != p.bytes {
+			j.progress[key] = &transferProgress{bytes: bytes, since: now}
+			continue
+		}
+		if now.Sub(p.since) < stall {
+			continue
+		}
+
+		if !p.restarted && len(open) > 0 {
+			log.Infof("janitor: retrieval %v of %s has made no progress for %v, restarting its transfers", h.DealID, h.PayloadCid, stall)
+			for _, xfer := range open {
+				if err := api.ClientRestartDataTransfer(ctx, xfer.TransferID, xfer.OtherPeer, xfer.IsInitiator); err != nil {
+					log.Debugf("restarting data transfer channel %v failed: %s", xfer.TransferID, err)
+				}
+			}
+			p.restarted = true
+			p.since = now
+			restarted++
+			continue
+		}
+
+		log.Infof("janitor: retrieval %v of %s has made no progress for %v, cancelling it", h.DealID, h.PayloadCid, stall)
+		if err := h.cancel(api); err != nil {
+			log.Errorf("janitor: cancelling retrieval %v failed: %s", h.DealID, err)
+			continue
+		}
+		ownedRetrievals.forget(h.DealID)
+		delete(j.progress, key)
+		cancelled++
+	}
+
+	// Forget about retrievals that have ended
+	for key := range j.progress {
+		if !seen[key] {
+			delete(j.progress, key)
+		}
+	}
+	return restarted, cancelled
+}
+
+// Removes racer downloads in dir for pieces no active job is working on. They are named after the
+// destination CAR, which starts with the piece CID. Returns the number of files removed
+func CleanupOrphanedDownloads(dir string, activePieces map[string]bool) int {
+	var paths []string
+	for _, pattern := range []string{"*.race", "*.race.part"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			log.Errorf("listing downloads: %s", err)
+			return 0
+		}
+		paths = append(paths, matches...)
+	}
+
+	removed := 0
+	for _, path := range paths {
+		pieceCid := strings.SplitN(filepath.Base(path), ".", 2)[0]
+		if activePieces[pieceCid] || partialsInUse.getValue(path) > 0 {
+			continue
+		}
+
+		log.Debugf("removing orphaned download %s", path)
+		if strings.HasSuffix(path, ".part") {
+			removePartial(path)
+		} else if err := os.Remove(path); err != nil {
+			continue
+		}
+		removed++
+	}
+	return removed
+}
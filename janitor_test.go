@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	lapi "github.com/filecoin-project/lotus/api"
+	"github.com/libp2p/go-libp2p/core/test"
+)
+
+func TestJanitorRestartsThenCancelsStalledRetrievals(t *testing.T) {
+	ownedRetrievals = newOwnedRetrievalTracker()
+	us, provider := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	stalledChannel := datatransfer.ChannelID{Initiator: us, Responder: provider, ID: 1}
+	movingChannel := datatransfer.ChannelID{Initiator: us, Responder: provider, ID: 2}
+
+	node := &cancelRecordingNode{
+		retrievals: []lapi.RetrievalInfo{
+			{ID: 7, Status: retrievalmarket.DealStatusOngoing, TransferChannelID: &stalledChannel},
+			{ID: 8, Status: retrievalmarket.DealStatusOngoing, TransferChannelID: &movingChannel},
+			{ID: 9, Status: retrievalmarket.DealStatusOngoing}, // Not started by the dealbot
+		},
+		transfers: []lapi.DataTransferChannel{
+			{TransferID: 1, OtherPeer: provider, IsInitiator: true, Status: datatransfer.Ongoing, Transferred: 100},
+			{TransferID: 2, OtherPeer: provider, IsInitiator: true, Status: datatransfer.Ongoing, Transferred: 100},
+		},
+	}
+
+	stalled := &retrievalHandle{PayloadCid: "stalled", Provider: provider, DealID: 7}
+	moving := &retrievalHandle{PayloadCid: "moving", Provider: provider, DealID: 8}
+	ownedRetrievals.track(stalled)
+	ownedRetrievals.track(moving)
+
+	j := &transferJanitor{progress: make(map[string]*transferProgress)}
+	stall := 30 * time.Minute
+	start := time.Now()
+
+	for i, expected := range []struct{ restarted, cancelled int }{{0, 0}, {0, 0}, {1, 0}, {0, 0}, {0, 1}} {
+		node.transfers[1].Transferred += 100
+		now := start.Add(time.Duration(i) * stall / 2)
+		restarted, cancelled := j.checkTransfers(node, ownedRetrievals.all(), stall, now)
+		if restarted != expected.restarted || cancelled != expected.cancelled {
+			t.Errorf("run %d: expected %d restarted and %d cancelled, got %d and %d", i, expected.restarted, expected.cancelled, restarted, cancelled)
+		}
+	}
+
+	if len(node.restartedTransfers) != 1 || node.restartedTransfers[0] != 1 {
+		t.Errorf("expected only the stalled transfer to be restarted, got %v", node.restartedTransfers)
+	}
+	if len(node.cancelledDeals) != 1 || node.cancelledDeals[0] != 7 {
+		t.Errorf("expected only the stalled retrieval to be cancelled, got %v", node.cancelledDeals)
+	}
+	if owned := ownedRetrievals.all(); len(owned) != 1 || owned[0].DealID != 8 {
+		t.Errorf("expected the cancelled retrieval to be forgotten, got %+v", owned)
+	}
+}
+
+func TestCleanupOrphanedDownloads(t *testing.T) {
+	dir := t.TempDir()
+
+	orphan := filepath.Join(dir, "orphan.car.f01.race")
+	orphanPartial := filepath.Join(dir, "orphan.car.f02.race.part")
+	active := filepath.Join(dir, "active.car.f01.race")
+	resumable := partialPath(dir, "orphan")
+	for _, path := range []string{orphan, orphanPartial, active, resumable} {
+		ioutil.WriteFile(path, []byte("data"), 0644)
+	}
+	SaveJSON(partialMetaPath(orphanPartial), partialDownload{PieceCid: "orphan"})
+
+	if removed := CleanupOrphanedDownloads(dir, map[string]bool{"active": true}); removed != 2 {
+		t.Errorf("expected 2 orphaned downloads removed, got %d", removed)
+	}
+	if FileExists(orphan) || FileExists(orphanPartial) || FileExists(partialMetaPath(orphanPartial)) {
+		t.Error("expected racer downloads of inactive pieces to be removed")
+	}
+	if !FileExists(active) {
+		t.Error("expected racer downloads of active pieces to be kept")
+	}
+	if !FileExists(resumable) {
+		t.Error("expected shared partials to be left for a later attempt to resume")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	jobStarting   = "starting"
+	jobRetrieving = "retrieving"
+	jobVerifying  = "verifying"
+	jobProposing  = "waiting for proposal"
+	jobImporting  = "importing"
+)
+
+// A piece the dealbot is currently working on
+type activeJob struct {
+	PieceCid  string
+	Size      int64
+	Stage     string
+	Source    string
+	Received  int64
+	StartedAt time.Time
+}
+
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*activeJob
+}
+
+var activeJobs = &jobRegistry{jobs: make(map[string]*activeJob)}
+
+func (r *jobRegistry) start(pieceCid string, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.jobs[pieceCid] = &activeJob{
+		PieceCid:  pieceCid,
+		Size:      size,
+		Stage:     jobStarting,
+		StartedAt: time.Now(),
+	}
+}
+
+// Moves a job to the next stage. Does nothing if the piece isn't tracked
+func (r *jobRegistry) setStage(pieceCid string, stage string, source string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if job, found := r.jobs[pieceCid]; found {
+		job.Stage = stage
+		job.Source = source
+		job.Received = 0
+	}
+}
+
+// Records how many bytes of the piece have been retrieved so far
+func (r *jobRegistry) setReceived(pieceCid string, received int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if job, found := r.jobs[pieceCid]; found {
+		job.Received = received
+	}
+}
+
+func (r *jobRegistry) finish(pieceCid string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.jobs, pieceCid)
+}
+
+// Returns a copy of the active jobs, oldest first
+func (r *jobRegistry) list() []activeJob {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	jobs := make([]activeJob, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		jobs = append(jobs, *job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt.Before(jobs[j].StartedAt)
+	})
+	return jobs
+}
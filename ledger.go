@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// What a single retrieval paid, appended to the ledger once it finishes or fails
+type ledgerEntry struct {
+	Time       time.Time `json:"time"`
+	PayloadCid string    `json:"payload_cid"`
+	ProviderID string    `json:"provider_id"`
+	DealID     uint64    `json:"deal_id"`
+	Bytes      uint64    `json:"bytes"`
+	Paid       big.Int   `json:"paid"` // attoFIL
+	Completed  bool      `json:"completed"`
+
+	started bool // Whether the retrieval deal was made. Deal IDs start at 0, so the ID can't tell
+}
+
+// Daily and monthly spending limits, in attoFIL. Zero means unlimited
+type retrievalBudgets struct {
+	daily            big.Int
+	monthly          big.Int
+	spDaily          map[string]big.Int
+	spMonthly        map[string]big.Int
+	defaultSpDaily   big.Int
+	defaultSpMonthly big.Int
+}
+
+// Keeps a persistent record of what retrievals paid, and refuses paid offers once a budget is used up
+// Retrievals in progress reserve their offer price, so concurrent ones can't overspend
+type retrievalLedger struct {
+	mu sync.Mutex
+
+	entries  []ledgerEntry
+	reserved map[string]big.Int
+	budgets  retrievalBudgets
+	path     string
+}
+
+var paymentLedger = &retrievalLedger{reserved: make(map[string]big.Int)}
+
+// Loads the budgets from config, and the ledger from the state directory
+func InitRetrievalLedger(cfg EvergreenDealbotConfig) error {
+	l := paymentLedger
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var err error
+	if l.budgets.daily, err = parseFIL(cfg.Lotus.RetrievalDailyBudget); err != nil {
+		return fmt.Errorf("parsing RETRIEVAL_DAILY_BUDGET_FIL: %s", err)
+	}
+	if l.budgets.monthly, err = parseFIL(cfg.Lotus.RetrievalMonthlyBudget); err != nil {
+		return fmt.Errorf("parsing RETRIEVAL_MONTHLY_BUDGET_FIL: %s", err)
+	}
+	l.budgets.spDaily, l.budgets.defaultSpDaily, err = parseSpBudgets(cfg.Lotus.RetrievalSpDailyBudget)
+	if err != nil {
+		return fmt.Errorf("parsing RETRIEVAL_SP_DAILY_BUDGET_FIL: %s", err)
+	}
+	l.budgets.spMonthly, l.budgets.defaultSpMonthly, err = parseSpBudgets(cfg.Lotus.RetrievalSpMonthlyBudget)
+	if err != nil {
+		return fmt.Errorf("parsing RETRIEVAL_SP_MONTHLY_BUDGET_FIL: %s", err)
+	}
+
+	l.path = filepath.Join(cfg.Common.StateLocation, "retrieval-ledger.jsonl")
+	l.entries, err = loadLedger(l.path)
+	return err
+}
+
+// Parses an amount of FIL, where "" means 0
+func parseFIL(s string) (big.Int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return big.Zero(), nil
+	}
+
+	fil, err := types.ParseFIL(s)
+	if err != nil {
+		return big.Zero(), err
+	}
+	return big.Int(fil), nil
+}
+
+// Parses "<sp>=<FIL>,..." budgets, where a "*" SP sets the budget for unlisted SPs
+func parseSpBudgets(s string) (map[string]big.Int, big.Int, error) {
+	budgets := make(map[string]big.Int)
+	defaultBudget := big.Zero()
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, big.Zero(), fmt.Errorf("expected <sp>=<FIL>, got %q", entry)
+		}
+
+		amount, err := parseFIL(parts[1])
+		if err != nil {
+			return nil, big.Zero(), fmt.Errorf("invalid budget %q: %s", parts[1], err)
+		}
+
+		sp := strings.TrimSpace(parts[0])
+		if sp == "*" {
+			defaultBudget = amount
+		} else {
+			budgets[sp] = amount
+		}
+	}
+
+	return budgets, defaultBudget, nil
+}
+
+func loadLedger(path string) ([]ledgerEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []ledgerEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var e ledgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("parsing %s line %d: %s", path, line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func startOfMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Paid since the given time, plus what's reserved for retrievals in progress. sp "" counts all SPs
+func (l *retrievalLedger) committed(sp string, since time.Time) big.Int {
+	total := big.Zero()
+	for _, e := range l.entries {
+		if !e.Time.Before(since) && (sp == "" || e.ProviderID == sp) {
+			total = big.Add(total, e.Paid)
+		}
+	}
+	for reservedSp, amount := range l.reserved {
+		if sp == "" || reservedSp == sp {
+			total = big.Add(total, amount)
+		}
+	}
+	return total
+}
+
+// Returns an error naming the first budget that paying amount to sp would exceed
+func (l *retrievalLedger) checkBudgets(sp string, amount big.Int) error {
+	if amount.IsZero() {
+		return nil
+	}
+
+	now := time.Now()
+	spDaily, found := l.budgets.spDaily[sp]
+	if !found {
+		spDaily = l.budgets.defaultSpDaily
+	}
+	spMonthly, found := l.budgets.spMonthly[sp]
+	if !found {
+		spMonthly = l.budgets.defaultSpMonthly
+	}
+
+	checks := []struct {
+		name   string
+		budget big.Int
+		sp     string
+		since  time.Time
+	}{
+		{"daily", l.budgets.daily, "", startOfDay(now)},
+		{"monthly", l.budgets.monthly, "", startOfMonth(now)},
+		{"daily " + sp, spDaily, sp, startOfDay(now)},
+		{"monthly " + sp, spMonthly, sp, startOfMonth(now)},
+	}
+
+	for _, c := range checks {
+		if c.budget.IsZero() {
+			continue
+		}
+		if big.Add(l.committed(c.sp, c.since), amount).GreaterThan(c.budget) {
+			return fmt.Errorf("offer of %s from %s would exceed the %s retrieval budget of %s", types.FIL(amount), sp, c.name, types.FIL(c.budget))
+		}
+	}
+	return nil
+}
+
+// Checks whether paying amount to sp fits in the budgets, without reserving it
+func (l *retrievalLedger) canSpend(sp string, amount big.Int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.checkBudgets(sp, amount)
+}
+
+// Reserves amount for a retrieval from sp, or fails if it doesn't fit in the budgets
+// Must be followed by a call to settle, with the same amount
+func (l *retrievalLedger) reserve(sp string, amount big.Int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkBudgets(sp, amount); err != nil {
+		return err
+	}
+	if !amount.IsZero() {
+		l.reserved[sp] = big.Add(l.reservedFor(sp), amount)
+	}
+	return nil
+}
+
+func (l *retrievalLedger) reservedFor(sp string) big.Int {
+	if amount, found := l.reserved[sp]; found {
+		return amount
+	}
+	return big.Zero()
+}
+
+// Releases a reservation, and records what the retrieval actually paid if it got as far as a deal
+func (l *retrievalLedger) settle(reserved big.Int, e ledgerEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !reserved.IsZero() {
+		remaining := big.Sub(l.reservedFor(e.ProviderID), reserved)
+		if remaining.GreaterThan(big.Zero()) {
+			l.reserved[e.ProviderID] = remaining
+		} else {
+			delete(l.reserved, e.ProviderID)
+		}
+	}
+
+	// The retrieval never started, so nothing was paid
+	if !e.started {
+		return
+	}
+
+	if e.Paid.Nil() {
+		e.Paid = big.Zero()
+	}
+	e.Time = time.Now()
+	l.entries = append(l.entries, e)
+
+	if l.path == "" {
+		return
+	}
+	if err := appendLedgerEntry(l.path, e); err != nil {
+		log.Errorf("failed writing retrieval ledger: %s", err)
+	}
+}
+
+func appendLedgerEntry(path string, e ledgerEntry) error {
+	line, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Entries recorded in [from, to), oldest first
+func (l *retrievalLedger) between(from time.Time, to time.Time) []ledgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var result []ledgerEntry
+	for _, e := range l.entries {
+		if !e.Time.Before(from) && e.Time.Before(to) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// Writes the ledger entries for a period as CSV, followed by the total paid to each SP
+// period is "" for everything, "YYYY-MM" for a month or "YYYY-MM-DD" for a day
+func PrintLedger(w io.Writer, period string) error {
+	from, to := time.Time{}, time.Now().Add(time.Hour)
+	switch len(period) {
+	case 0:
+	case len("2006-01"):
+		month, err := time.Parse("2006-01", period)
+		if err != nil {
+			return err
+		}
+		from, to = month, month.AddDate(0, 1, 0)
+	case len("2006-01-02"):
+		day, err := time.Parse("2006-01-02", period)
+		if err != nil {
+			return err
+		}
+		from, to = day, day.AddDate(0, 0, 1)
+	default:
+		return fmt.Errorf("expected a period of YYYY-MM or YYYY-MM-DD, got %q", period)
+	}
+
+	entries := paymentLedger.between(from, to)
+	totals := make(map[string]big.Int)
+
+	fmt.Fprintln(w, "time,provider_id,payload_cid,deal_id,bytes,paid_fil,completed")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s,%s,%s,%d,%d,%s,%v\n", e.Time.UTC().Format(time.RFC3339), e.ProviderID, e.PayloadCid,
+			e.DealID, e.Bytes, types.FIL(e.Paid).Unitless(), e.Completed)
+
+		total, found := totals[e.ProviderID]
+		if !found {
+			total = big.Zero()
+		}
+		totals[e.ProviderID] = big.Add(total, e.Paid)
+	}
+
+	sps := make([]string, 0, len(totals))
+	for sp := range totals {
+		sps = append(sps, sp)
+	}
+	sort.Strings(sps)
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "provider_id,total_paid_fil")
+	grand := big.Zero()
+	for _, sp := range sps {
+		fmt.Fprintf(w, "%s,%s\n", sp, types.FIL(totals[sp]).Unitless())
+		grand = big.Add(grand, totals[sp])
+	}
+	fmt.Fprintf(w, "total,%s\n", types.FIL(grand).Unitless())
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+func fil(s string) big.Int {
+	return big.Int(types.MustParseFIL(s))
+}
+
+func testLedger(t *testing.T, daily string, spDaily string) EvergreenDealbotConfig {
+	var cfg EvergreenDealbotConfig
+	cfg.Common.StateLocation = t.TempDir()
+	cfg.Lotus.RetrievalDailyBudget = daily
+	cfg.Lotus.RetrievalSpDailyBudget = spDaily
+
+	paymentLedger = &retrievalLedger{reserved: make(map[string]big.Int)}
+	if err := InitRetrievalLedger(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestLedgerBudgets(t *testing.T) {
+	testLedger(t, "1", "f01=0.5,*=0.8")
+
+	// Free offers are never refused
+	if err := paymentLedger.reserve("f01", big.Zero()); err != nil {
+		t.Errorf("expected a free offer to be accepted, got %s", err)
+	}
+
+	if err := paymentLedger.reserve("f01", fil("0.4")); err != nil {
+		t.Fatal(err)
+	}
+	// The reservation counts against the SP budget while the retrieval runs
+	if err := paymentLedger.canSpend("f01", fil("0.2")); err == nil {
+		t.Error("expected f01's daily budget to be used up by the reservation")
+	}
+
+	paymentLedger.settle(fil("0.4"), ledgerEntry{ProviderID: "f01", DealID: 1, Paid: fil("0.3"), Completed: true, started: true})
+	if err := paymentLedger.canSpend("f01", fil("0.2")); err != nil {
+		t.Errorf("expected the unpaid part of the reservation to be released, got %s", err)
+	}
+
+	// The default SP budget applies to f02, and the global budget to both
+	if err := paymentLedger.canSpend("f02", fil("0.9")); err == nil {
+		t.Error("expected f02 to be held to the default SP budget")
+	}
+	if err := paymentLedger.canSpend("f02", fil("0.75")); err == nil {
+		t.Error("expected the global daily budget to be exceeded")
+	}
+	if err := paymentLedger.canSpend("f02", fil("0.7")); err != nil {
+		t.Errorf("expected 0.7 FIL to fit, got %s", err)
+	}
+}
+
+func TestLedgerPersistAndPrint(t *testing.T) {
+	cfg := testLedger(t, "", "")
+
+	// Lotus numbers retrieval deals from 0
+	paymentLedger.settle(big.Zero(), ledgerEntry{ProviderID: "f01", PayloadCid: "payload-a", DealID: 0, Bytes: 100, Paid: fil("0.25"), Completed: true, started: true})
+	paymentLedger.settle(big.Zero(), ledgerEntry{ProviderID: "f02", PayloadCid: "payload-b", DealID: 2, Bytes: 50, Paid: fil("0.5"), started: true})
+	paymentLedger.settle(big.Zero(), ledgerEntry{ProviderID: "f01", PayloadCid: "payload-c", DealID: 3, Bytes: 10, Paid: fil("0.25"), Completed: true, started: true})
+	// Never started, so not recorded
+	paymentLedger.settle(big.Zero(), ledgerEntry{ProviderID: "f03", PayloadCid: "payload-d"})
+
+	// Read the entries back from the ledger file
+	paymentLedger = &retrievalLedger{reserved: make(map[string]big.Int)}
+	if err := InitRetrievalLedger(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(paymentLedger.entries) != 3 {
+		t.Fatalf("expected 3 ledger entries, got %d", len(paymentLedger.entries))
+	}
+
+	var out bytes.Buffer
+	if err := PrintLedger(&out, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{",f02,payload-b,2,50,0.5,false\n", "f01,0.5\n", "f02,0.5\n", "total,1\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected ledger output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+
+	if err := PrintLedger(&out, "2001-01"); err != nil {
+		t.Fatal(err)
+	}
+	if err := PrintLedger(&out, "last week"); err == nil {
+		t.Error("expected an invalid period to be rejected")
+	}
+}
+
+func TestParseSpBudgets(t *testing.T) {
+	budgets, defaultBudget, err := parseSpBudgets("f01=1.5, *=0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !budgets["f01"].Equals(fil("1.5")) || !defaultBudget.Equals(fil("0.1")) {
+		t.Errorf("unexpected budgets %v, default %v", budgets, defaultBudget)
+	}
+
+	for _, s := range []string{"f01", "f01=lots"} {
+		if _, _, err := parseSpBudgets(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"time"
 
 	bapi "github.com/filecoin-project/boost/api"
+	"github.com/filecoin-project/go-address"
 	jsonrpc "github.com/filecoin-project/go-jsonrpc"
 	lapi "github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/api/client"
@@ -63,6 +65,35 @@ func StorageMinerConnection(marketApiInfo string) (lapi.StorageMiner, jsonrpc.Cl
 	return storageMinerApi, storageMinerCloser, nil
 }
 
+// Connects to a lotus-wallet style JSON-RPC endpoint, used to keep the worker key off the full node
+func WalletConnection(walletApiInfo string) (lapi.Wallet, jsonrpc.ClientCloser, error) {
+	info := cliutil.ParseApiInfo(walletApiInfo)
+
+	addr, err := info.DialArgs("v0")
+	if err != nil {
+		log.Errorf("Error getting v0 Wallet API address %s", err)
+		return nil, nil, err
+	}
+
+	return client.NewWalletRPCV0(context.Background(), addr, info.AuthHeader())
+}
+
+// Looks up the SP ID of the connected miner
+func MinerActorAddress(minerApiInfo string) (address.Address, error) {
+	storageMinerApi, smCloser, err := StorageMinerConnection(minerApiInfo)
+	if err != nil {
+		return address.Undef, err
+	}
+	defer smCloser()
+
+	spid, err := storageMinerApi.ActorAddress(context.Background())
+	if err != nil {
+		return address.Undef, fmt.Errorf("failed getting SPID: %s", err)
+	}
+
+	return spid, nil
+}
+
 func BoostJsonRpcConnection(boostUrl string, boostAuthToken string) (*bapi.BoostStruct, jsonrpc.ClientCloser, error) {
 	headers := http.Header{"Authorization": []string{"Bearer " + boostAuthToken}}
 	ctx := context.Background()
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/filecoin-project/go-address"
@@ -16,33 +18,148 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func RetrieveCar(c string, peer string, path string, cfg EvergreenDealbotConfig) (bool, error) {
-	ctx := context.Background()
+// How long an offer made to a query is kept for the retrieval that follows it
+const recentOfferTTL = 5 * time.Minute
 
+type recentOffer struct {
+	offer     lapi.QueryOffer
+	cost      big.Int
+	fetchedAt time.Time
+}
+
+// Offers made to queries, by SP and payload, so a retrieval doesn't have to query the SP again
+var recentOffersMu sync.Mutex
+var recentOffers = make(map[string]recentOffer)
+
+func recentOfferKey(peer string, payloadCid string) string {
+	return peer + "/" + payloadCid
+}
+
+func rememberOffer(peer string, payloadCid string, offer lapi.QueryOffer, cost big.Int) {
+	recentOffersMu.Lock()
+	defer recentOffersMu.Unlock()
+
+	for key, o := range recentOffers {
+		if time.Since(o.fetchedAt) > recentOfferTTL {
+			delete(recentOffers, key)
+		}
+	}
+	recentOffers[recentOfferKey(peer, payloadCid)] = recentOffer{offer: offer, cost: cost, fetchedAt: time.Now()}
+}
+
+// Returns the offer a recent query got, if any. Each offer is only used once
+func takeRecentOffer(peer string, payloadCid string) (lapi.QueryOffer, big.Int, bool) {
+	recentOffersMu.Lock()
+	defer recentOffersMu.Unlock()
+
+	key := recentOfferKey(peer, payloadCid)
+	o, found := recentOffers[key]
+	delete(recentOffers, key)
+	if !found || time.Since(o.fetchedAt) > recentOfferTTL {
+		return lapi.QueryOffer{}, big.Zero(), false
+	}
+	return o.offer, o.cost, true
+}
+
+// Retrieves pieces with a graphsync retrieval through the lotus client, exporting the CAR to dest
+type graphsyncRetrievalBackend struct {
+	cfg EvergreenDealbotConfig
+}
+
+func (b *graphsyncRetrievalBackend) Name() string {
+	return "graphsync"
+}
+
+func (b *graphsyncRetrievalBackend) Query(ctx context.Context, pieceCid string, payloadCid string, pieceSize int64, source Source) (RetrievalOffer, error) {
+	api, closer, err := LotusConnection(b.cfg.Lotus.FullNodeApiInfo)
+	defer closer()
+	if err != nil {
+		return RetrievalOffer{}, fmt.Errorf("error creating lotus connection %s", err)
+	}
+
+	file, err := cid.Parse(payloadCid)
+	if err != nil {
+		return RetrievalOffer{}, fmt.Errorf("parsing cid failed: %s", err)
+	}
+
+	offer, cost, err := queryOffer(ctx, api, source.ProviderID, file, pieceSize, b.cfg)
+	if err != nil {
+		return RetrievalOffer{}, err
+	}
+	rememberOffer(source.ProviderID, payloadCid, offer, cost)
+	return RetrievalOffer{Price: cost}, nil
+}
+
+func (b *graphsyncRetrievalBackend) Retrieve(ctx context.Context, pieceCid string, payloadCid string, pieceSize int64, source Source, dest string, progress RetrievalProgress) error {
+	_, err := RetrieveCar(ctx, payloadCid, source.ProviderID, pieceSize, dest, b.cfg, progress)
+	if errors.Is(err, errInvalidCar) {
+		rejectCar(dest, pieceCid, source.ProviderID, failureInvalidCar, b.cfg)
+	}
+	return err
+}
+
+// Asks the SP for a retrieval offer, and works out its total cost for a piece of pieceSize
+// Fails if the offer errors, costs more than MAX_RETRIEVAL_PRICE or MAX_RETRIEVAL_COST_PER_GIB allow,
+// or doesn't fit in the retrieval budgets
+func queryOffer(ctx context.Context, api v1api.FullNode, peer string, file cid.Cid, pieceSize int64, cfg EvergreenDealbotConfig) (lapi.QueryOffer, big.Int, error) {
+	minerAddr, err := address.NewFromString(peer)
+	if err != nil {
+		return lapi.QueryOffer{}, big.Zero(), err
+	}
+
+	offer, err := api.ClientMinerQueryOffer(ctx, minerAddr, file, nil)
+	if err != nil {
+		return lapi.QueryOffer{}, big.Zero(), err
+	}
+
+	if offer.Err != "" {
+		return lapi.QueryOffer{}, big.Zero(), fmt.Errorf("offer error: %s", offer.Err)
+	}
+
+	maxPrice := types.MustParseFIL(cfg.Lotus.MaxRetrievalPrice)
+	if offer.MinPrice.GreaterThan(big.Int(maxPrice)) {
+		return lapi.QueryOffer{}, big.Zero(), fmt.Errorf("%w: no offer satisfying maxPrice: %s", errOfferRefused, maxPrice)
+	}
+
+	cost := retrievalCost(offer, pieceSize)
+	if err := checkRetrievalCost(cost, pieceSize, cfg); err != nil {
+		return lapi.QueryOffer{}, big.Zero(), fmt.Errorf("%w: %s", errOfferRefused, err)
+	}
+	if err := paymentLedger.canSpend(peer, cost); err != nil {
+		return lapi.QueryOffer{}, big.Zero(), fmt.Errorf("%w: %s", errOfferRefused, err)
+	}
+
+	return offer, cost, nil
+}
+
+// Retrieves the payload c from the SP peer into a CAR at path, or exports it if lotus already has it
+// Returns the handle of the retrieval deal, if one was made. If ctx is cancelled or the retrieval
+// fails, exactly that deal and its data transfers are cancelled
+func RetrieveCar(ctx context.Context, c string, peer string, pieceSize int64, path string, cfg EvergreenDealbotConfig, progress RetrievalProgress) (*retrievalHandle, error) {
 	// ### The following code was taken from lotus client_retr.go, `retrieve()` function
 
 	api, closer, err := LotusConnection(cfg.Lotus.FullNodeApiInfo)
 	defer closer()
 	if err != nil {
-		return false, fmt.Errorf("error creating lotus connection %s", err)
+		return nil, fmt.Errorf("error creating lotus connection %s", err)
 	}
 
 	// Wallet that will pay for the retrieval (not required for now)
 	payer, err := api.WalletDefaultAddress(ctx)
 	if err != nil {
-		return false, fmt.Errorf("error getting default wallet address: %s", err)
+		return nil, fmt.Errorf("error getting default wallet address: %s", err)
 	}
 
 	// Cid of the thing we want to retrieve
 	file, err := cid.Parse(c)
 	if err != nil {
-		return false, fmt.Errorf("parsing cid failed: %s", err)
+		return nil, fmt.Errorf("parsing cid failed: %s", err)
 	}
 
 	// Handle the --allow-local flag, retrieve from local datastore if it exists
 	imports, err := api.ClientListImports(ctx)
 	if err != nil {
-		return false, fmt.Errorf("error handling client list imports: %s", err)
+		return nil, fmt.Errorf("error handling client list imports: %s", err)
 	}
 
 	var eref *lapi.ExportRef
@@ -59,49 +176,67 @@ func RetrieveCar(c string, peer string, path string, cfg EvergreenDealbotConfig)
 	// Return the locally retrieved eref
 
 	if eref != nil {
-		exportCar(ctx, api, eref, path)
-		return true, nil
-	}
-
-	minerAddr, err := address.NewFromString(peer)
-	if err != nil {
-		return false, err
-	}
-
-	offer, err := api.ClientMinerQueryOffer(ctx, minerAddr, file, nil)
-	if err != nil {
-		return false, err
-	}
-
-	if offer.Err != "" {
-		return false, fmt.Errorf("offer error: %s", offer.Err)
+		if err := exportCar(ctx, api, eref, path); err != nil {
+			return nil, fmt.Errorf("error exporting local CAR: %w", err)
+		}
+		return nil, validateExport(path, c, pieceSize)
 	}
 
-	maxPrice := types.MustParseFIL(cfg.Lotus.MaxRetrievalPrice)
-	if offer.MinPrice.GreaterThan(big.Int(maxPrice)) {
-		return false, fmt.Errorf("failed to find offer satisfying maxPrice: %s", maxPrice)
+	// The SP was usually just queried to pick the cheapest source
+	offer, cost, found := takeRecentOffer(peer, c)
+	if !found {
+		offer, cost, err = queryOffer(ctx, api, peer, file, pieceSize, cfg)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	o := offer.Order(payer)
 	o.DataSelector = nil
 
+	// Hold the offer price against the retrieval budgets until we know what was actually paid
+	if err := paymentLedger.reserve(peer, cost); err != nil {
+		return nil, fmt.Errorf("%w: %s", errOfferRefused, err)
+	}
+	payment := ledgerEntry{PayloadCid: c, ProviderID: peer, Paid: big.Zero()}
+	defer func() {
+		paymentLedger.settle(cost, payment)
+	}()
+
 	subscribeEvents, err := api.ClientGetRetrievalUpdates(ctx)
 	if err != nil {
-		return false, fmt.Errorf("failure setting up retrieval updates: %w", err)
+		return nil, fmt.Errorf("failure setting up retrieval updates: %w", err)
 	}
 
+	// Lotus only hands out a deal ID once the deal has started. Without one there is nothing that can be
+	// cancelled without risking other retrievals of the same payload, e.g. from racing sources
 	retrievalRes, err := api.ClientRetrieve(ctx, o)
-
 	if err != nil {
-		return false, fmt.Errorf("failure setting up retrieval: %w", err)
+		return nil, fmt.Errorf("failure setting up retrieval: %w", err)
 	}
 
+	handle := &retrievalHandle{PayloadCid: c, Provider: offer.MinerPeer.ID, DealID: retrievalRes.DealID}
+	payment.DealID = uint64(retrievalRes.DealID)
+	payment.started = true
+	ownedRetrievals.track(handle)
+
+	finished := false
+	defer func() {
+		if !finished {
+			if err := handle.cancel(api); err != nil {
+				ownedRetrievals.abandon(handle.DealID)
+				return
+			}
+		}
+		ownedRetrievals.forget(handle.DealID)
+	}()
+
 	start := time.Now()
 	lastEvt := time.Now()
 	to := time.Duration(cfg.Lotus.RetrievalTimeout) * time.Minute
 
 	ticker := time.NewTicker(10 * time.Second)
-	quitTicker := make(chan struct{})
+	defer ticker.Stop()
 
 readEvents:
 	for {
@@ -110,13 +245,11 @@ readEvents:
 		case <-ticker.C:
 			if time.Since(lastEvt) > to {
 				// Timeout has elapsed - end the retrieval
-				ticker.Stop()
-				close(quitTicker)
-				return false, fmt.Errorf("retrieval timed out after %v minutes", cfg.Lotus.RetrievalTimeout)
+				return handle, fmt.Errorf("%w after %v minutes", errRetrievalTimeout, cfg.Lotus.RetrievalTimeout)
 			}
 			continue
 		case <-ctx.Done():
-			return false, fmt.Errorf("lotus retrieval timed out")
+			return handle, fmt.Errorf("lotus retrieval cancelled: %w", ctx.Err())
 		case evt = <-subscribeEvents:
 			if evt.ID != retrievalRes.DealID {
 				// we can't check the deal ID ahead of time because:
@@ -124,6 +257,9 @@ readEvents:
 				// 2. We won't know the deal ID until after retrieving.
 				continue
 			}
+			if handle.addChannel(evt.TransferChannelID) {
+				ownedRetrievals.track(handle)
+			}
 		}
 
 		event := "New"
@@ -135,6 +271,9 @@ readEvents:
 
 		// Recv 1.354 KiB, Paid 0 FIL, BlocksReceived (Ongoing), 232ms
 		lastEvt = time.Now()
+		payment.Paid = evt.TotalPaid
+		payment.Bytes = evt.BytesReceived
+		progress(int64(evt.BytesReceived), -1)
 		log.Debugf("Recv %s, Paid %s, %s (%s), %s\n",
 			types.SizeStr(types.NewInt(evt.BytesReceived)),
 			types.FIL(evt.TotalPaid),
@@ -147,13 +286,13 @@ readEvents:
 		case retrievalmarket.DealStatusCompleted:
 			break readEvents
 		case retrievalmarket.DealStatusRejected:
-			return false, fmt.Errorf("retrieval proposal rejected: %s", evt.Message)
+			return handle, fmt.Errorf("%w: %s", errRetrievalRejected, evt.Message)
 		case retrievalmarket.DealStatusCancelled:
-			return false, fmt.Errorf("retrieval proposal cancelled: %s", evt.Message)
+			return handle, fmt.Errorf("retrieval proposal cancelled: %s", evt.Message)
 		case
 			retrievalmarket.DealStatusDealNotFound,
 			retrievalmarket.DealStatusErrored:
-			return false, fmt.Errorf("retrieval error: %s", evt.Message)
+			return handle, fmt.Errorf("retrieval error: %s", evt.Message)
 		}
 	}
 
@@ -165,10 +304,20 @@ readEvents:
 	// Export CAR
 	err = exportCar(ctx, api, eref, path)
 	if err != nil {
-		return false, fmt.Errorf("error exporting CAR: %w", err)
+		return handle, fmt.Errorf("error exporting CAR: %w", err)
 	}
 
-	return true, nil
+	finished = true
+	payment.Completed = true
+	return handle, validateExport(path, c, pieceSize)
+}
+
+// Catches truncated, wrong-root or oversized exports before anything else looks at the file
+func validateExport(path string, payloadCid string, pieceSize int64) error {
+	if err := ValidateCar(path, payloadCid, pieceSize); err != nil {
+		return fmt.Errorf("exported CAR failed validation: %w", err)
+	}
+	return nil
 }
 
 func exportCar(ctx context.Context, api v1api.FullNode, eref *lapi.ExportRef, path string) error {
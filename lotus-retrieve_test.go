@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/big"
+	lapi "github.com/filecoin-project/lotus/api"
+)
+
+func TestRecentOffersAreUsedOnce(t *testing.T) {
+	rememberOffer("f01", "payload", lapi.QueryOffer{Size: 100}, big.NewInt(5))
+
+	if _, _, found := takeRecentOffer("f02", "payload"); found {
+		t.Error("expected no offer from another SP")
+	}
+	offer, cost, found := takeRecentOffer("f01", "payload")
+	if !found || offer.Size != 100 || !cost.Equals(big.NewInt(5)) {
+		t.Fatalf("expected the queried offer, got %+v costing %v", offer, cost)
+	}
+	if _, _, found := takeRecentOffer("f01", "payload"); found {
+		t.Error("expected the offer to only be used once")
+	}
+
+	// Offers too old to trust are queried again
+	rememberOffer("f01", "payload", lapi.QueryOffer{}, big.Zero())
+	recentOffersMu.Lock()
+	o := recentOffers[recentOfferKey("f01", "payload")]
+	o.fetchedAt = time.Now().Add(-2 * recentOfferTTL)
+	recentOffers[recentOfferKey("f01", "payload")] = o
+	recentOffersMu.Unlock()
+	if _, _, found := takeRecentOffer("f01", "payload"); found {
+		t.Error("expected a stale offer to be ignored")
+	}
+}
+
+func TestValidateExportChecksPieceSize(t *testing.T) {
+	data, root := testCar(t, []byte("root block"), []byte("second block"))
+	path := writeTestCar(t, data)
+
+	if err := validateExport(path, root.String(), 256); err != nil {
+		t.Errorf("expected an export that fits the piece to be valid, got %s", err)
+	}
+	if err := validateExport(path, root.String(), 64); !errors.Is(err, errInvalidCar) {
+		t.Errorf("expected an export too big for the piece to be rejected, got %v", err)
+	}
+}
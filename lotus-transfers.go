@@ -7,84 +7,80 @@ import (
 
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
-	"github.com/filecoin-project/lotus/api"
-	"github.com/ipfs/go-cid"
+	"github.com/filecoin-project/lotus/api/v1api"
+	"github.com/libp2p/go-libp2p/core/peer"
 	log "github.com/sirupsen/logrus"
 )
 
-func CancelRetrieval(payloadCidToCancel string, cfg EvergreenDealbotConfig) error {
-	ctx := context.Background()
+// A graphsync retrieval started by RetrieveCar: the lotus retrieval deal, and the data transfer
+// channels it has opened. Cancelling it leaves every other retrieval alone, even for the same payload
+type retrievalHandle struct {
+	PayloadCid string
+	Provider   peer.ID
+	DealID     retrievalmarket.DealID
+	Channels   []datatransfer.ChannelID
+}
 
-	cid, err := cid.Parse(payloadCidToCancel)
-	if err != nil {
-		return fmt.Errorf("failed parsing cid: %s", err)
+// Adds a channel the retrieval is using, returning false if it was already known
+// Restarted transfers open new channels
+func (h *retrievalHandle) addChannel(chid *datatransfer.ChannelID) bool {
+	if chid == nil {
+		return false
 	}
-
-	api, closer, err := LotusConnection(cfg.Lotus.FullNodeApiInfo)
-	defer closer()
-	if err != nil {
-		return fmt.Errorf("error creating lotus connection %s", err)
+	for _, known := range h.Channels {
+		if known == *chid {
+			return false
+		}
 	}
+	h.Channels = append(h.Channels, *chid)
+	return true
+}
 
-	retrievals, err := api.ClientListRetrievals(ctx)
-	if err != nil {
-		return fmt.Errorf("listing retrievals failed: %s", err)
+// The peer at the other end of one of the retrieval's channels, and whether we opened it
+// Retrieval clients normally open the channel, but the provider may have restarted it
+func (h *retrievalHandle) channelPeer(chid datatransfer.ChannelID) (peer.ID, bool) {
+	if chid.Initiator == h.Provider {
+		return chid.Initiator, false
 	}
+	return chid.Responder, true
+}
 
-	found := false
-
-	var rid retrievalmarket.DealID
-
-	for _, retrieval := range retrievals {
-		if retrieval.PayloadCID == cid {
-			if retrieval.Status == retrievalmarket.DealStatusCancelled || retrieval.Status == retrievalmarket.DealStatusCancelling {
-				continue
+// Cancels the retrieval deal, unless lotus has already finished with it, and its data transfer channels
+// Uses its own context, as the retrieval's may already be cancelled
+func (h *retrievalHandle) cancel(api v1api.FullNode) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The channel may not have shown up in any update yet
+	ended := false
+	if retrievals, err := api.ClientListRetrievals(ctx); err == nil {
+		ended = true
+		for _, r := range retrievals {
+			if r.ID == h.DealID {
+				h.addChannel(r.TransferChannelID)
+				ended = retrievalmarket.IsTerminalStatus(r.Status)
 			}
-			api.ClientCancelRetrievalDeal(ctx, rid)
-			found = true
 		}
 	}
 
-	// Sometimes the transfer cancelling will block, so let's time it out
-	cancelTimeoutChan := make(chan bool, 1)
-	go func() {
-		res := cancelTransfersForCid(ctx, api, cid)
-		cancelTimeoutChan <- res
-	}()
-
-	select {
-	case <-cancelTimeoutChan:
-		break
-	case <-time.After(10 * time.Second):
-		log.Debug("cancelling transfers timed out")
-		break
-	}
-
-	if !found {
-		return fmt.Errorf("unable to find matching retrieval")
-	}
-
-	return nil
-}
-
-func cancelTransfersForCid(ctx context.Context, api api.FullNode, cid cid.Cid) bool {
-	transfers, err := api.ClientListDataTransfers(ctx)
-	if err != nil {
-		log.Errorf("listing transfers failed: %s", err)
-		return false
+	var err error
+	if !ended {
+		if err = api.ClientCancelRetrievalDeal(ctx, h.DealID); err != nil {
+			log.Debugf("cancelling retrieval %v failed: %s", h.DealID, err)
+		} else {
+			log.Debugf("cancelled retrieval %v", h.DealID)
+		}
 	}
 
-	for _, xfer := range transfers {
-		if xfer.BaseCID == cid {
-			if xfer.Status == datatransfer.Cancelled || xfer.Status == datatransfer.Cancelling {
-				continue
-			}
-			api.ClientCancelDataTransfer(ctx, xfer.TransferID, xfer.OtherPeer, xfer.IsInitiator)
-			log.Debugf("cancelling data transfer channel %v", xfer.TransferID)
+	for _, chid := range h.Channels {
+		otherPeer, isInitiator := h.channelPeer(chid)
+		if err := api.ClientCancelDataTransfer(ctx, chid.ID, otherPeer, isInitiator); err != nil {
+			log.Debugf("cancelling data transfer channel %v failed: %s", chid, err)
+			continue
 		}
+		log.Debugf("cancelling data transfer channel %v", chid)
 	}
-
-	return true
+	return err
 }
 
 func CancelAllRetrievals(cfg EvergreenDealbotConfig) error {
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	lapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/v1api"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Records the cancellations and restarts made through the lotus API. Calling anything else panics
+type cancelRecordingNode struct {
+	v1api.FullNode
+
+	retrievals         []lapi.RetrievalInfo
+	transfers          []lapi.DataTransferChannel
+	cancelledDeals     []retrievalmarket.DealID
+	cancelledTransfers []datatransfer.TransferID
+	restartedTransfers []datatransfer.TransferID
+	initiators         []bool
+}
+
+func (n *cancelRecordingNode) ClientListRetrievals(ctx context.Context) ([]lapi.RetrievalInfo, error) {
+	return n.retrievals, nil
+}
+
+func (n *cancelRecordingNode) ClientListDataTransfers(ctx context.Context) ([]lapi.DataTransferChannel, error) {
+	return n.transfers, nil
+}
+
+func (n *cancelRecordingNode) ClientRestartDataTransfer(ctx context.Context, transferID datatransfer.TransferID, otherPeer peer.ID, isInitiator bool) error {
+	n.restartedTransfers = append(n.restartedTransfers, transferID)
+	return nil
+}
+
+func (n *cancelRecordingNode) ClientCancelRetrievalDeal(ctx context.Context, dealID retrievalmarket.DealID) error {
+	n.cancelledDeals = append(n.cancelledDeals, dealID)
+	return nil
+}
+
+func (n *cancelRecordingNode) ClientCancelDataTransfer(ctx context.Context, transferID datatransfer.TransferID, otherPeer peer.ID, isInitiator bool) error {
+	n.cancelledTransfers = append(n.cancelledTransfers, transferID)
+	n.initiators = append(n.initiators, isInitiator)
+	return nil
+}
+
+func TestRetrievalHandleCancelsOnlyItsOwn(t *testing.T) {
+	us, provider, other := peer.ID("us"), peer.ID("provider"), peer.ID("other")
+	first := datatransfer.ChannelID{Initiator: us, Responder: provider, ID: 1}
+	restarted := datatransfer.ChannelID{Initiator: provider, Responder: us, ID: 2}
+	unseen := datatransfer.ChannelID{Initiator: us, Responder: provider, ID: 3}
+	otherRetrieval := datatransfer.ChannelID{Initiator: us, Responder: other, ID: 4}
+
+	node := &cancelRecordingNode{retrievals: []lapi.RetrievalInfo{
+		{ID: 7, TransferChannelID: &unseen},
+		{ID: 8, TransferChannelID: &otherRetrieval},
+	}}
+
+	h := &retrievalHandle{PayloadCid: "payload", Provider: provider, DealID: 7}
+	h.addChannel(&first)
+	h.addChannel(&first)
+	h.addChannel(nil)
+	h.addChannel(&restarted)
+	h.cancel(node)
+
+	if len(node.cancelledDeals) != 1 || node.cancelledDeals[0] != 7 {
+		t.Errorf("expected only deal 7 to be cancelled, got %v", node.cancelledDeals)
+	}
+	expected := []datatransfer.TransferID{1, 2, 3}
+	if len(node.cancelledTransfers) != len(expected) {
+		t.Fatalf("expected transfers %v to be cancelled, got %v", expected, node.cancelledTransfers)
+	}
+	for i, id := range expected {
+		if node.cancelledTransfers[i] != id {
+			t.Errorf("expected transfers %v to be cancelled, got %v", expected, node.cancelledTransfers)
+			break
+		}
+	}
+	if !node.initiators[0] || node.initiators[1] {
+		t.Errorf("expected to cancel as the initiator only for channels we opened, got %v", node.initiators)
+	}
+}
+
+func TestRetrievalHandleSkipsEndedDeals(t *testing.T) {
+	node := &cancelRecordingNode{retrievals: []lapi.RetrievalInfo{
+		{ID: 7, Status: retrievalmarket.DealStatusCompleted},
+	}}
+
+	h := &retrievalHandle{DealID: 7}
+	if err := h.cancel(node); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.cancelledDeals) != 0 {
+		t.Errorf("expected a completed deal not to be cancelled, got %v", node.cancelledDeals)
+	}
+
+	// Deals lotus no longer knows about have ended too
+	h = &retrievalHandle{DealID: 9}
+	h.cancel(node)
+	if len(node.cancelledDeals) != 0 {
+		t.Errorf("expected an unknown deal not to be cancelled, got %v", node.cancelledDeals)
+	}
+}
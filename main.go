@@ -26,26 +26,92 @@ func main() {
 		log.Debugf("log File not specified. outputting logs only to terminal")
 	}
 
+	if len(os.Args) > 1 {
+		runCommand(cfg, os.Args[1:])
+		return
+	}
+
 	// Uncomment this to turn logs into JSON format
 	// log.SetFormatter(&log.JSONFormatter{})
 	log.Infoln(" ---- ")
 	log.Info("begin Evergreen dealbot!")
 
-	CancelAllRetrievals(cfg)
-	CancelAllTransfers(cfg)
+	// Clean up after a previous run, without touching retrievals started by anything else
+	if err := InitOwnedRetrievals(cfg); err != nil {
+		log.Fatalf("error loading owned retrievals: %s", err)
+	}
+	if cancelled, err := CleanupOwnedRetrievals(cfg); err != nil {
+		log.Errorf("cleaning up retrievals: %s", err)
+	} else if cancelled > 0 {
+		log.Infof("cancelled %d retrievals left over from a previous run", cancelled)
+	}
 
 	// threadManager(cfg)
 }
 
+// Runs a one-off command instead of the dealbot
+func runCommand(cfg EvergreenDealbotConfig, args []string) {
+	switch args[0] {
+	case "ledger":
+		if err := InitRetrievalLedger(cfg); err != nil {
+			log.Fatalf("error loading retrieval ledger: %s", err)
+		}
+
+		period := ""
+		if len(args) > 1 {
+			period = args[1]
+		}
+		if err := PrintLedger(os.Stdout, period); err != nil {
+			log.Fatal(err)
+		}
+	case "cancel-all":
+		// Cancels every retrieval and data transfer on the lotus node, whoever started them
+		if err := CancelAllRetrievals(cfg); err != nil {
+			log.Fatal(err)
+		}
+		if err := CancelAllTransfers(cfg); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown command %q, expected: ledger [YYYY-MM|YYYY-MM-DD] or cancel-all", args[0])
+	}
+}
+
 func threadManager(cfg EvergreenDealbotConfig) {
 	doneChan := make(chan bool)
 	var numActiveThreads uint = 0
 
-	go WatcherThread(cfg)
+	ec, err := NewEvergreenClient(cfg)
+	if err != nil {
+		log.Fatalf("error setting up evergreen client: %s", err)
+	}
+
+	err = InitTrackers(cfg)
+	if err != nil {
+		log.Fatalf("error setting up trackers: %s", err)
+	}
+
+	err = InitRetrievalBackends(cfg)
+	if err != nil {
+		log.Fatalf("error setting up retrieval backends: %s", err)
+	}
+	InitProposalWaiters(cfg)
+
+	// Start polling pending proposals right away, so deadlines and pending bytes are known early
+	spid, err := MinerActorAddress(cfg.Lotus.MinerApiInfo)
+	if err != nil {
+		log.Fatalf("error getting miner address: %s", err)
+	}
+	ProposalPollerFor(ec, spid)
+
+	go CatalogRefresherThread(ec, cfg)
+	go StatusThread(cfg)
+	go JanitorThread(cfg)
+	go WatcherThread(ec, cfg)
 
 	for {
 		if numActiveThreads < cfg.Common.MaxThreads {
-			go DealbotThread(doneChan, cfg)
+			go DealbotThread(doneChan, ec, cfg)
 			numActiveThreads++
 			log.Debugf("spawning a new thread. there are now %d active \n", numActiveThreads)
 			continue
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/libp2p/go-libp2p/core/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+// A retrieval the dealbot started, saved until it ends so it can be cleaned up after a crash
+// The provider's peer ID is kept as a string, as an empty peer.ID can't be read back from JSON
+type ownedRetrieval struct {
+	PayloadCid string
+	Provider   string
+	DealID     retrievalmarket.DealID
+	Channels   []datatransfer.ChannelID
+	StartedAt  time.Time
+}
+
+func (r *ownedRetrieval) handle() retrievalHandle {
+	h := retrievalHandle{PayloadCid: r.PayloadCid, DealID: r.DealID, Channels: r.Channels}
+	if provider, err := peer.Decode(r.Provider); err == nil {
+		h.Provider = provider
+	}
+	return h
+}
+
+// Keeps the retrievals and transfer channels the dealbot started, so cleanup never touches those
+// started by operators or other tools on the same lotus node
+// They are saved as soon as they change, as they are needed most after a crash. Only the retrievals are
+// saved: none of them are running in a new process
+type ownedRetrievalTracker struct {
+	mu sync.Mutex
+
+	retrievals map[string]*ownedRetrieval // By deal ID
+	running    map[string]bool            // Started by this process and not finished yet
+	state      *persistedState
+}
+
+var ownedRetrievals = newOwnedRetrievalTracker()
+
+func newOwnedRetrievalTracker() *ownedRetrievalTracker {
+	t := &ownedRetrievalTracker{
+		retrievals: make(map[string]*ownedRetrieval),
+		running:    make(map[string]bool),
+	}
+	t.state = newPersistedState("owned-retrievals.json", &t.mu, &t.retrievals, 0)
+	return t
+}
+
+// Loads the retrievals left behind by previous runs from the state directory
+func InitOwnedRetrievals(cfg EvergreenDealbotConfig) error {
+	t := ownedRetrievals
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state.load(cfg.Common.StateLocation)
+}
+
+func dealKey(dealID retrievalmarket.DealID) string {
+	return strconv.FormatUint(uint64(dealID), 10)
+}
+
+// Records a retrieval this process is running, or the channels it has opened since
+func (t *ownedRetrievalTracker) track(h *retrievalHandle) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := dealKey(h.DealID)
+	owned, found := t.retrievals[key]
+	if !found {
+		owned = &ownedRetrieval{StartedAt: time.Now()}
+		t.retrievals[key] = owned
+	}
+	owned.PayloadCid = h.PayloadCid
+	owned.DealID = h.DealID
+	owned.Channels = append([]datatransfer.ChannelID(nil), h.Channels...)
+	if h.Provider != "" {
+		owned.Provider = h.Provider.String()
+	}
+	t.running[key] = true
+	t.state.changed()
+}
+
+// Stops tracking a retrieval once it has finished or been cancelled
+func (t *ownedRetrievalTracker) forget(dealID retrievalmarket.DealID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := dealKey(dealID)
+	delete(t.retrievals, key)
+	delete(t.running, key)
+	t.state.changed()
+}
+
+// Hands a retrieval that couldn't be cancelled over to the periodic cleanup
+func (t *ownedRetrievalTracker) abandon(dealID retrievalmarket.DealID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.running, dealKey(dealID))
+}
+
+// Retrievals the dealbot started that this process isn't running, oldest first
+func (t *ownedRetrievalTracker) abandoned() []retrievalHandle {
+	return t.list(false)
+}
+
+// Every retrieval the dealbot started that hasn't ended yet, oldest first
+func (t *ownedRetrievalTracker) all() []retrievalHandle {
+	return t.list(true)
+}
+
+func (t *ownedRetrievalTracker) list(includeRunning bool) []retrievalHandle {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var owned []*ownedRetrieval
+	for key, r := range t.retrievals {
+		if includeRunning || !t.running[key] {
+			owned = append(owned, r)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool {
+		return owned[i].StartedAt.Before(owned[j].StartedAt)
+	})
+
+	handles := make([]retrievalHandle, 0, len(owned))
+	for _, r := range owned {
+		handles = append(handles, r.handle())
+	}
+	return handles
+}
+
+// Cancels the retrievals and transfer channels the dealbot started but is no longer running, e.g.
+// those left behind by a crash. Retrievals and transfers started by anything else are left alone
+// Returns the number cancelled
+func CleanupOwnedRetrievals(cfg EvergreenDealbotConfig) (int, error) {
+	handles := ownedRetrievals.abandoned()
+	if len(handles) == 0 {
+		return 0, nil
+	}
+
+	api, closer, err := LotusConnection(cfg.Lotus.FullNodeApiInfo)
+	if err != nil {
+		return 0, fmt.Errorf("error creating lotus connection %s", err)
+	}
+	defer closer()
+
+	cancelled := 0
+	for _, h := range handles {
+		log.Debugf("cleaning up retrieval %v of %s", h.DealID, h.PayloadCid)
+		if err := h.cancel(api); err != nil {
+			log.Errorf("cancelling retrieval %v failed, will try again later: %s", h.DealID, err)
+			continue
+		}
+		ownedRetrievals.forget(h.DealID)
+		cancelled++
+	}
+	return cancelled, nil
+}
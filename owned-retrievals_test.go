@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/libp2p/go-libp2p/core/test"
+)
+
+func TestOwnedRetrievalsAbandonedAfterRestart(t *testing.T) {
+	var cfg EvergreenDealbotConfig
+	cfg.Common.StateLocation = t.TempDir()
+
+	ownedRetrievals = newOwnedRetrievalTracker()
+	if err := InitOwnedRetrievals(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	us, provider := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	running := &retrievalHandle{PayloadCid: "payload-a", Provider: provider, DealID: 1}
+	running.addChannel(&datatransfer.ChannelID{Initiator: us, Responder: provider, ID: 10})
+	ownedRetrievals.track(running)
+	ownedRetrievals.track(&retrievalHandle{PayloadCid: "payload-b", DealID: 2})
+	ownedRetrievals.forget(2)
+	ownedRetrievals.track(&retrievalHandle{PayloadCid: "payload-c", DealID: 3})
+	ownedRetrievals.abandon(3)
+
+	abandoned := ownedRetrievals.abandoned()
+	if len(abandoned) != 1 || abandoned[0].DealID != 3 {
+		t.Errorf("expected only retrieval 3 to be abandoned, got %+v", abandoned)
+	}
+
+	// After a restart, nothing is running any more
+	ownedRetrievals = newOwnedRetrievalTracker()
+	if err := InitOwnedRetrievals(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	abandoned = ownedRetrievals.abandoned()
+	if len(abandoned) != 2 || abandoned[0].DealID != 1 || abandoned[1].DealID != 3 {
+		t.Fatalf("expected retrievals 1 and 3 to be left over, got %+v", abandoned)
+	}
+	if h := abandoned[0]; h.Provider != provider || len(h.Channels) != 1 || h.Channels[0].ID != 10 {
+		t.Errorf("expected the provider and channels to be saved, got %+v", h)
+	}
+}
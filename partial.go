@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often the progress of a download is saved. At most this much is downloaded again after a crash
+const partialCheckpointInterval = 10 * time.Second
+
+// Progress of an interrupted download, saved next to the partial file so a later attempt can resume it
+type partialDownload struct {
+	PieceCid  string
+	Offset    int64 // Bytes of the partial file known to be on disk
+	Total     int64 // Size of the piece if known, or -1
+	Source    string
+	UpdatedAt time.Time
+}
+
+// Partial files currently being written, so two retrievals never append to the same one
+var partialsInUse = &syncMap{m: make(map[string]uint)}
+
+// The shared partial for a piece, which any source that supports resuming can continue
+func partialPath(dir string, pieceCid string) string {
+	return filepath.Join(dir, pieceCid+".part")
+}
+
+// Claims the piece's shared partial for a download to dest. If another source is already writing it,
+// a partial of dest's own is used instead. The returned func releases the claim
+func claimPartial(dest string, pieceCid string) (string, func()) {
+	path := partialPath(filepath.Dir(dest), pieceCid)
+	if !partialsInUse.acquire(path, 1) {
+		path = dest + ".part"
+		partialsInUse.acquire(path, 1)
+	}
+
+	return path, func() {
+		partialsInUse.release(path)
+	}
+}
+
+// Removes the piece's shared partial and its progress once the piece has been retrieved some other way,
+// e.g. by a racer with a partial of its own or over another backend. Left alone while a download is using it
+func removeSharedPartial(dir string, pieceCid string) {
+	path := partialPath(dir, pieceCid)
+	if !partialsInUse.acquire(path, 1) {
+		return
+	}
+	defer partialsInUse.release(path)
+
+	if FileExists(path) || FileExists(partialMetaPath(path)) {
+		log.Debugf("removing partial download %s, the piece has been retrieved", path)
+		removePartial(path)
+	}
+}
+
+func partialMetaPath(path string) string {
+	return path + ".json"
+}
+
+// Returns the progress saved for a partial file, or an empty one to start from zero
+// Progress is discarded if the file is shorter than the recorded offset, or belongs to another piece
+func loadPartial(path string, pieceCid string) partialDownload {
+	fresh := partialDownload{PieceCid: pieceCid, Total: -1}
+
+	var p partialDownload
+	if err := LoadJSON(partialMetaPath(path), &p); err != nil {
+		log.Debugf("ignoring partial download %s: %s", path, err)
+		return fresh
+	}
+	if p.PieceCid != pieceCid || p.Offset <= 0 {
+		return fresh
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Size() < p.Offset {
+		return fresh
+	}
+	return p
+}
+
+func savePartial(path string, p partialDownload) error {
+	p.UpdatedAt = time.Now()
+	return SaveJSON(partialMetaPath(path), p)
+}
+
+func removePartial(path string) {
+	os.Remove(path)
+	os.Remove(partialMetaPath(path))
+}
+
+// Writes to a partial file, saving how much of it is on disk every partialCheckpointInterval
+type partialWriter struct {
+	f       *os.File
+	path    string
+	state   *partialDownload
+	savedAt time.Time
+}
+
+func (w *partialWriter) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	w.state.Offset += int64(n)
+
+	if err == nil && time.Since(w.savedAt) > partialCheckpointInterval {
+		err = w.checkpoint()
+	}
+	return n, err
+}
+
+// Flushes the partial file to disk, then records the offset it reached
+func (w *partialWriter) checkpoint() error {
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.savedAt = time.Now()
+	return savePartial(w.path, *w.state)
+}
+
+// Removes partial downloads in dir that haven't been written to for maxAge, skipping any in use
+// Returns the number removed
+func CleanupStalePartials(dir string, maxAge time.Duration) int {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.part"))
+	if err != nil {
+		log.Errorf("listing partial downloads: %s", err)
+		return 0
+	}
+
+	removed := 0
+	for _, path := range paths {
+		if partialsInUse.getValue(path) > 0 {
+			continue
+		}
+
+		updatedAt := time.Time{}
+		var p partialDownload
+		if err := LoadJSON(partialMetaPath(path), &p); err == nil {
+			updatedAt = p.UpdatedAt
+		}
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(updatedAt) {
+			updatedAt = info.ModTime()
+		}
+
+		if time.Since(updatedAt) > maxAge {
+			log.Debugf("removing stale partial download %s", path)
+			removePartial(path)
+			removed++
+		}
+	}
+
+	// Progress files left behind without their partial
+	metas, _ := filepath.Glob(filepath.Join(dir, "*.part.json"))
+	for _, meta := range metas {
+		if !FileExists(strings.TrimSuffix(meta, ".json")) {
+			os.Remove(meta)
+		}
+	}
+
+	return removed
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadPartial(t *testing.T) {
+	dir := t.TempDir()
+	path := partialPath(dir, "piece")
+
+	if p := loadPartial(path, "piece"); p.Offset != 0 || p.Total != -1 {
+		t.Errorf("expected a fresh start without a partial, got %+v", p)
+	}
+
+	ioutil.WriteFile(path, make([]byte, 100), 0644)
+	savePartial(path, partialDownload{PieceCid: "piece", Offset: 100, Total: 500})
+
+	if p := loadPartial(path, "piece"); p.Offset != 100 || p.Total != 500 {
+		t.Errorf("expected to resume from 100 of 500, got %+v", p)
+	}
+	if p := loadPartial(path, "other"); p.Offset != 0 {
+		t.Error("progress for another piece should be ignored")
+	}
+
+	// The file lost data the progress says was written
+	os.Truncate(path, 50)
+	if p := loadPartial(path, "piece"); p.Offset != 0 {
+		t.Error("progress past the end of the file should be ignored")
+	}
+}
+
+func TestClaimPartial(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "piece.car.f01.race")
+
+	first, releaseFirst := claimPartial(dest, "piece")
+	second, releaseSecond := claimPartial(dest, "piece")
+	defer releaseSecond()
+
+	if first != partialPath(dir, "piece") {
+		t.Errorf("expected the shared partial first, got %s", first)
+	}
+	if second != dest+".part" {
+		t.Errorf("expected a private partial while the shared one is in use, got %s", second)
+	}
+
+	releaseFirst()
+	third, releaseThird := claimPartial(dest, "piece")
+	defer releaseThird()
+	if third != first {
+		t.Error("expected the shared partial to be free again")
+	}
+}
+
+func TestRemoveSharedPartial(t *testing.T) {
+	dir := t.TempDir()
+	shared := partialPath(dir, "piece")
+	ioutil.WriteFile(shared, make([]byte, 100), 0644)
+	savePartial(shared, partialDownload{PieceCid: "piece", Offset: 100})
+
+	// Still being written by another download
+	_, release := claimPartial(filepath.Join(dir, "piece.car"), "piece")
+	removeSharedPartial(dir, "piece")
+	if !FileExists(shared) {
+		t.Fatal("expected a partial in use to be kept")
+	}
+
+	release()
+	removeSharedPartial(dir, "piece")
+	if FileExists(shared) || FileExists(partialMetaPath(shared)) {
+		t.Error("expected the partial and its progress to be removed")
+	}
+}
+
+func TestCleanupStalePartials(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+
+	stale := partialPath(dir, "stale")
+	ioutil.WriteFile(stale, []byte("data"), 0644)
+	SaveJSON(partialMetaPath(stale), partialDownload{PieceCid: "stale", UpdatedAt: old})
+	os.Chtimes(stale, old, old)
+
+	inUse := partialPath(dir, "in-use")
+	ioutil.WriteFile(inUse, []byte("data"), 0644)
+	os.Chtimes(inUse, old, old)
+	partialsInUse.acquire(inUse, 1)
+	defer partialsInUse.release(inUse)
+
+	fresh := partialPath(dir, "fresh")
+	ioutil.WriteFile(fresh, []byte("data"), 0644)
+
+	orphan := partialMetaPath(partialPath(dir, "orphan"))
+	ioutil.WriteFile(orphan, []byte("{}"), 0644)
+
+	if removed := CleanupStalePartials(dir, 24*time.Hour); removed != 1 {
+		t.Errorf("expected 1 stale partial removed, got %d", removed)
+	}
+	if FileExists(stale) || FileExists(partialMetaPath(stale)) {
+		t.Error("stale partial should be removed")
+	}
+	if !FileExists(inUse) || !FileExists(fresh) {
+		t.Error("partials in use or recently written should be kept")
+	}
+	if FileExists(orphan) {
+		t.Error("progress without a partial should be removed")
+	}
+}
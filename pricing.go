@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/go-state-types/big"
+	lapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+const gib = 1 << 30
+
+// Expected total cost of retrieving a piece with an offer: the unseal price, plus the price per byte
+// for the whole padded piece. The payment interval only changes when the SP is paid, not how much
+func retrievalCost(offer lapi.QueryOffer, paddedSize int64) big.Int {
+	return big.Add(offer.UnsealPrice, big.Mul(offer.PricePerByte, big.NewInt(paddedSize)))
+}
+
+// Checks a retrieval cost against MAX_RETRIEVAL_COST_PER_GIB, scaled to the size of the piece
+func checkRetrievalCost(cost big.Int, paddedSize int64, cfg EvergreenDealbotConfig) error {
+	maxPerGiB, err := parseFIL(cfg.Lotus.MaxRetrievalCostPerGiB)
+	if err != nil {
+		return fmt.Errorf("parsing MAX_RETRIEVAL_COST_PER_GIB: %s", err)
+	}
+	if cfg.Lotus.MaxRetrievalCostPerGiB == "" {
+		return nil
+	}
+
+	limit := big.Div(big.Mul(maxPerGiB, big.NewInt(paddedSize)), big.NewInt(gib))
+	if cost.GreaterThan(limit) {
+		return fmt.Errorf("offer costs %s, more than the %s limit for a %d byte piece", types.FIL(cost), types.FIL(limit), paddedSize)
+	}
+	return nil
+}
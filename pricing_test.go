@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/big"
+	lapi "github.com/filecoin-project/lotus/api"
+)
+
+func TestRetrievalCost(t *testing.T) {
+	offer := lapi.QueryOffer{
+		MinPrice:     big.Zero(),
+		UnsealPrice:  fil("0.5"),
+		PricePerByte: big.NewInt(2),
+	}
+
+	// The unseal price is counted, even though the per byte price is tiny
+	cost := retrievalCost(offer, gib)
+	if expected := big.Add(fil("0.5"), big.NewInt(2*gib)); !cost.Equals(expected) {
+		t.Errorf("expected %s, got %s", expected, cost)
+	}
+
+	var cfg EvergreenDealbotConfig
+	if err := checkRetrievalCost(cost, gib, cfg); err != nil {
+		t.Errorf("expected no limit by default, got %s", err)
+	}
+
+	cfg.Lotus.MaxRetrievalCostPerGiB = "0.1"
+	if err := checkRetrievalCost(cost, gib, cfg); err == nil {
+		t.Error("expected the unseal price to push the offer over the limit")
+	}
+	// The limit scales with the piece size
+	if err := checkRetrievalCost(cost, 32*gib, cfg); err != nil {
+		t.Errorf("expected the offer to fit the limit for a 32GiB piece, got %s", err)
+	}
+
+	cfg.Lotus.MaxRetrievalCostPerGiB = "cheap"
+	if err := checkRetrievalCost(cost, gib, cfg); err == nil {
+		t.Error("expected an invalid limit to be rejected")
+	}
+}
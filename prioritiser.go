@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Learned from RequestDeal responses, keyed by piece CID
+type replicaCount struct {
+	counts    map[string]int64
+	learnedAt time.Time
+}
+
+// Number of replicas Evergreen reported for the piece, using the "total" count if present
+func (r replicaCount) total() int64 {
+	if total, found := r.counts["total"]; found {
+		return total
+	}
+
+	var max int64 = 0
+	for _, c := range r.counts {
+		if c > max {
+			max = c
+		}
+	}
+	return max
+}
+
+type rankedDeal struct {
+	deal          EvergreenDeal
+	replicas      int64
+	known         bool // Whether replicas can be trusted, it can't if an expiration couldn't be parsed
+	soonestExpiry time.Time
+}
+
+// Orders deals so the ones that help the program most come first:
+// fewest live replicas, then the replicas that expire soonest
+// Deals whose replica count isn't known go last. Deals that rank equally are shuffled, so concurrent
+// threads spread over them
+func prioritiseDeals(deals []EvergreenDeal, learned map[string]replicaCount) []EvergreenDeal {
+	now := time.Now()
+	ranked := make([]rankedDeal, 0, len(deals))
+
+	for _, d := range deals {
+		r := rankedDeal{deal: d, known: true}
+
+		var live int64 = 0
+		for _, source := range d.Sources {
+			expiration, err := time.Parse(time.RFC3339, source.DealExpiration)
+			if err != nil {
+				r.known = false
+				continue
+			}
+			if expiration.Before(now) {
+				continue
+			}
+			live++
+			if r.soonestExpiry.IsZero() || expiration.Before(r.soonestExpiry) {
+				r.soonestExpiry = expiration
+			}
+		}
+
+		r.replicas = live
+		if counts, found := learned[d.PieceCid]; found {
+			r.replicas = counts.total()
+			r.known = true
+		}
+
+		ranked = append(ranked, r)
+	}
+
+	rand.Shuffle(len(ranked), func(i, j int) { ranked[i], ranked[j] = ranked[j], ranked[i] })
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].known != ranked[j].known {
+			return ranked[i].known
+		}
+		if ranked[i].replicas != ranked[j].replicas {
+			return ranked[i].replicas < ranked[j].replicas
+		}
+		// Unknown expirations go last
+		if ranked[i].soonestExpiry.IsZero() != ranked[j].soonestExpiry.IsZero() {
+			return !ranked[i].soonestExpiry.IsZero()
+		}
+		return ranked[i].soonestExpiry.Before(ranked[j].soonestExpiry)
+	})
+
+	result := make([]EvergreenDeal, len(ranked))
+	for i, r := range ranked {
+		result[i] = r.deal
+	}
+	return result
+}
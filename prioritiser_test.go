@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrioritiseDeals(t *testing.T) {
+	soon := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	later := time.Now().Add(90 * 24 * time.Hour).UTC().Format(time.RFC3339)
+	expired := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	deals := []EvergreenDeal{
+		{PieceCid: "two-later", Sources: []Source{{DealExpiration: later}, {DealExpiration: later}}},
+		{PieceCid: "two-soon", Sources: []Source{{DealExpiration: soon}, {DealExpiration: later}}},
+		{PieceCid: "one-live", Sources: []Source{{DealExpiration: later}, {DealExpiration: expired}}},
+		{PieceCid: "learned", Sources: []Source{{DealExpiration: soon}}},
+		{PieceCid: "unparseable", Sources: []Source{{DealExpiration: "sometime"}}},
+	}
+	learned := map[string]replicaCount{
+		"learned": {counts: map[string]int64{"total": 5, "in_org": 1}},
+	}
+
+	ranked := prioritiseDeals(deals, learned)
+
+	expected := []string{"one-live", "two-soon", "two-later", "learned", "unparseable"}
+	for i, d := range ranked {
+		if d.PieceCid != expected[i] {
+			t.Fatalf("unexpected order at %d: got %s, expected %v", i, d.PieceCid, expected)
+		}
+	}
+}
+
+func TestCatalogCachesRanking(t *testing.T) {
+	c := &dealCatalog{ready: make(chan struct{})}
+	c.update(&AvailableDeals{ResponseStateEpoch: 1, Response: []EvergreenDeal{{PieceCid: "a"}, {PieceCid: "b"}}})
+
+	first := c.PrioritisedDeals()
+	if second := c.PrioritisedDeals(); &second[0] != &first[0] {
+		t.Error("expected the ranking to be reused for the same snapshot")
+	}
+
+	// Learning replica counts changes the ranking
+	c.learnReplicas("a", map[string]int64{"total": 3})
+	c.learnReplicas("b", map[string]int64{"total": 1})
+	if ranked := c.PrioritisedDeals(); ranked[0].PieceCid != "b" {
+		t.Errorf("expected b to rank first with fewer replicas, got %v", ranked)
+	}
+
+	c.update(&AvailableDeals{ResponseStateEpoch: 2, Response: []EvergreenDeal{{PieceCid: "c"}}})
+	if ranked := c.PrioritisedDeals(); len(ranked) != 1 || ranked[0].PieceCid != "c" {
+		t.Errorf("expected the new snapshot to be ranked, got %v", ranked)
+	}
+}
+
+func TestCatalogKeepsReplicaCountsAcrossSwaps(t *testing.T) {
+	c := &dealCatalog{ready: make(chan struct{})}
+	c.update(&AvailableDeals{ResponseStateEpoch: 1, Response: []EvergreenDeal{{PieceCid: "a"}, {PieceCid: "b"}}})
+
+	c.learnReplicas("a", map[string]int64{"total": 3})
+	c.learnReplicas("b", map[string]int64{"total": 1})
+
+	c.update(&AvailableDeals{ResponseStateEpoch: 2, Response: []EvergreenDeal{{PieceCid: "a"}}})
+
+	if r, found := c.replicas["a"]; !found || r.total() != 3 {
+		t.Errorf("replica count for a should survive the swap, got %+v", r)
+	}
+	if _, found := c.replicas["b"]; found {
+		t.Error("replica count for b should be dropped once it is no longer available")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Interval while jobs are waiting on a proposal, or new retrievals are paused on the pending bytes cap
+	proposalPollFast = 30 * time.Second
+	// Interval when nothing is waiting, just to keep deadlines and pending bytes current
+	proposalPollSlow = 10 * time.Minute
+	// Longest wait between polls after consecutive failures
+	proposalPollMaxBackoff = 30 * time.Minute
+)
+
+// Fetches pending_proposals for an SP on behalf of every job, and hands each proposal to the jobs waiting on its piece
+// The results also feed the pending bytes tracker and the deal deadlines
+type proposalPoller struct {
+	spid address.Address
+	ec   EvergreenClient
+
+	mu          sync.Mutex
+	subscribers map[string][]chan PendingProposal
+	failures    uint
+	lastPoll    time.Time
+
+	wake chan struct{}
+}
+
+var proposalPollersMu sync.Mutex
+var proposalPollers = make(map[address.Address]*proposalPoller)
+
+// Returns the poller for an SP, starting it on first use
+func ProposalPollerFor(ec EvergreenClient, spid address.Address) *proposalPoller {
+	proposalPollersMu.Lock()
+	defer proposalPollersMu.Unlock()
+
+	p, found := proposalPollers[spid]
+	if !found {
+		p = newProposalPoller(ec, spid)
+		proposalPollers[spid] = p
+		go p.run()
+	}
+	return p
+}
+
+// Asks every poller to poll again as soon as the fast interval allows
+func wakeProposalPollers() {
+	proposalPollersMu.Lock()
+	defer proposalPollersMu.Unlock()
+
+	for _, p := range proposalPollers {
+		p.pollSoon()
+	}
+}
+
+func newProposalPoller(ec EvergreenClient, spid address.Address) *proposalPoller {
+	return &proposalPoller{
+		spid:        spid,
+		ec:          ec,
+		subscribers: make(map[string][]chan PendingProposal),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Returns a channel that receives the proposal for pieceCid once it shows up, and a func to unsubscribe
+func (p *proposalPoller) Subscribe(pieceCid string) (<-chan PendingProposal, func()) {
+	ch := make(chan PendingProposal, 1)
+
+	p.mu.Lock()
+	p.subscribers[pieceCid] = append(p.subscribers[pieceCid], ch)
+	p.mu.Unlock()
+
+	p.pollSoon()
+
+	return ch, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		subs := p.subscribers[pieceCid]
+		for i, s := range subs {
+			if s == ch {
+				subs = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+		if len(subs) == 0 {
+			delete(p.subscribers, pieceCid)
+		} else {
+			p.subscribers[pieceCid] = subs
+		}
+	}
+}
+
+// Waits up to timeout for the proposal for pieceCid
+func (p *proposalPoller) Wait(pieceCid string, timeout time.Duration) (*PendingProposal, error) {
+	ch, unsubscribe := p.Subscribe(pieceCid)
+	defer unsubscribe()
+
+	select {
+	case proposal := <-ch:
+		return &proposal, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no proposal for %s after %v", pieceCid, timeout)
+	}
+}
+
+func (p *proposalPoller) pollSoon() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *proposalPoller) run() {
+	for {
+		p.poll()
+
+		select {
+		case <-time.After(p.nextInterval()):
+		case <-p.wake:
+			// Don't poll more often than the fast interval, even when woken up
+			p.mu.Lock()
+			wait := time.Until(p.lastPoll.Add(proposalPollFast))
+			p.mu.Unlock()
+			time.Sleep(wait)
+		}
+	}
+}
+
+func (p *proposalPoller) poll() {
+	response, err := p.ec.GetPendingProposals(p.spid)
+
+	p.mu.Lock()
+	p.lastPoll = time.Now()
+	if err != nil {
+		p.failures++
+		p.mu.Unlock()
+		log.Debugf("failed fetching pending proposals for %s: %s", p.spid, err)
+		return
+	}
+	p.failures = 0
+	p.mu.Unlock()
+
+	proposals := response.Response.PendingProposals
+	pendingBytes.updateFromProposals(proposals)
+	dealDeadlines.updateProposals(proposals)
+	p.deliver(proposals)
+}
+
+// Hands the proposals to the jobs waiting on them. Each subscriber gets at most one proposal
+func (p *proposalPoller) deliver(proposals []PendingProposal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, proposal := range proposals {
+		subs, found := p.subscribers[proposal.PieceCid]
+		if !found {
+			continue
+		}
+
+		for _, ch := range subs {
+			ch <- proposal
+		}
+		delete(p.subscribers, proposal.PieceCid)
+	}
+}
+
+// Polls quickly while anyone is waiting, slowly otherwise, and backs off exponentially on failures
+func (p *proposalPoller) nextInterval() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.failures > 0 {
+		backoff := proposalPollMaxBackoff
+		if p.failures < 16 && proposalPollFast<<p.failures < backoff {
+			backoff = proposalPollFast << p.failures
+		}
+		return backoff
+	}
+
+	if len(p.subscribers) > 0 || pendingBytes.isPaused() {
+		return proposalPollFast
+	}
+	return proposalPollSlow
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+)
+
+type countingProposalsClient struct {
+	EvergreenClient
+
+	mu        sync.Mutex
+	calls     int
+	proposals []PendingProposal
+}
+
+func (c *countingProposalsClient) GetPendingProposals(spid address.Address) (*PendingProposalsResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.calls++
+	var r PendingProposalsResponse
+	r.Response.PendingProposals = c.proposals
+	return &r, nil
+}
+
+func TestProposalPollerDeliversToAllWaiters(t *testing.T) {
+	ec := &countingProposalsClient{}
+	spid, _ := address.NewIDAddress(1000)
+	p := newProposalPoller(ec, spid)
+
+	first, unsubscribeFirst := p.Subscribe("a")
+	defer unsubscribeFirst()
+	second, unsubscribeSecond := p.Subscribe("a")
+	defer unsubscribeSecond()
+	other, unsubscribeOther := p.Subscribe("b")
+	defer unsubscribeOther()
+
+	ec.proposals = []PendingProposal{{PieceCid: "a", DealProposalCid: "prop-a"}}
+	p.poll()
+
+	for _, ch := range []<-chan PendingProposal{first, second} {
+		select {
+		case proposal := <-ch:
+			if proposal.DealProposalCid != "prop-a" {
+				t.Errorf("unexpected proposal %+v", proposal)
+			}
+		default:
+			t.Error("waiter for a should have received its proposal")
+		}
+	}
+
+	select {
+	case proposal := <-other:
+		t.Errorf("waiter for b should not have received %+v", proposal)
+	default:
+	}
+
+	if ec.calls != 1 {
+		t.Errorf("expected a single pending_proposals request for all waiters, got %d", ec.calls)
+	}
+	if interval := p.nextInterval(); interval != proposalPollFast {
+		t.Errorf("expected the fast interval while b is waiting, got %v", interval)
+	}
+
+	unsubscribeOther()
+	if interval := p.nextInterval(); interval != proposalPollSlow {
+		t.Errorf("expected the slow interval once nothing is waiting, got %v", interval)
+	}
+}
+
+func TestProposalPollerWaitTimesOut(t *testing.T) {
+	p := newProposalPoller(&countingProposalsClient{}, address.Undef)
+
+	if _, err := p.Wait("missing", 10*time.Millisecond); err == nil {
+		t.Error("expected an error when the proposal never shows up")
+	}
+	if len(p.subscribers) != 0 {
+		t.Errorf("waiter should unsubscribe after timing out, got %d subscribers", len(p.subscribers))
+	}
+}
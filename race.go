@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long sources get to make an offer before the race starts without them
+const raceQueryTimeout = time.Minute
+
+// A source that made an offer for a piece
+type raceCandidate struct {
+	source Source
+	offer  RetrievalOffer
+}
+
+type raceResult struct {
+	source Source
+	file   string
+	err    error
+}
+
+// Queries all the sources for an offer at once, returning those that made one, cheapest first
+// Sources with the same provider are only queried once, and chronically failing providers not at all
+// Ties go to the provider with the better reputation, then keep the order they were given in
+func queryOffers(ctx context.Context, r *retrievalBackendRegistry, pieceCid string, payloadCid string, pieceSize int64, sources []Source) []raceCandidate {
+	ctx, cancel := context.WithTimeout(ctx, raceQueryTimeout)
+	defer cancel()
+
+	var unique []Source
+	seen := make(map[string]bool)
+	for _, source := range sources {
+		if seen[source.ProviderID] {
+			continue
+		}
+		seen[source.ProviderID] = true
+
+		if r.reputation.chronic(source.ProviderID) {
+			log.Debugf("skipping SP %s for %v, it has been failing retrievals", source.ProviderID, pieceCid)
+			continue
+		}
+		unique = append(unique, source)
+	}
+
+	offers := make([]*RetrievalOffer, len(unique))
+	var wg sync.WaitGroup
+	for i, source := range unique {
+		wg.Add(1)
+		go func(i int, source Source) {
+			defer wg.Done()
+
+			offer, err := r.Query(ctx, pieceCid, payloadCid, pieceSize, source)
+			if err != nil {
+				log.Debugln(err)
+				return
+			}
+			offers[i] = &offer
+		}(i, source)
+	}
+	wg.Wait()
+
+	var candidates []raceCandidate
+	for i, offer := range offers {
+		if offer != nil {
+			candidates = append(candidates, raceCandidate{source: unique[i], offer: *offer})
+		}
+	}
+
+	scores := make(map[string]float64)
+	for _, c := range candidates {
+		scores[c.source.ProviderID] = r.reputation.score(c.source.ProviderID)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		pi, pj := candidates[i].offer.Price, candidates[j].offer.Price
+		if !pi.Equals(pj) {
+			return pi.LessThan(pj)
+		}
+		return scores[candidates[i].source.ProviderID] > scores[candidates[j].source.ProviderID]
+	})
+	return candidates
+}
+
+// Retrieves a piece from up to width candidates at once, each into its own file next to dest
+// When a racer fails the next candidate takes its place. The first to finish is moved to dest,
+// and the others are cancelled and cleaned up in the background
+// Each racer holds a slot in spUsage while it runs, candidates whose SP has maxPerSp running are skipped
+// progress reports the racer that has received the most so far
+func raceRetrieval(ctx context.Context, r *retrievalBackendRegistry, pieceCid string, payloadCid string, pieceSize int64, candidates []raceCandidate, width int, spUsage *syncMap, maxPerSp uint, dest string, progress RetrievalProgress) (Source, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan raceResult)
+	running := 0
+	next := 0
+	var errs []string
+
+	var progressMu sync.Mutex
+	received := make(map[string]int64)
+
+	// Starts the next candidate with a free slot, returns false if there are none left
+	startNext := func() bool {
+		for next < len(candidates) {
+			source := candidates[next].source
+			next++
+
+			if !spUsage.acquire(source.ProviderID, maxPerSp) {
+				log.Debug("reached max concurrent queries for SP " + source.ProviderID)
+				continue
+			}
+
+			log.Debugf("racing SP %s for %v", source.ProviderID, pieceCid)
+			file := dest + "." + source.ProviderID + ".race"
+			running++
+
+			go func() {
+				err := r.Retrieve(ctx, pieceCid, payloadCid, pieceSize, source, file, func(n int64, total int64) {
+					progressMu.Lock()
+					received[source.ProviderID] = n
+					furthest := int64(0)
+					for _, v := range received {
+						if v > furthest {
+							furthest = v
+						}
+					}
+					progressMu.Unlock()
+					progress(furthest, total)
+				})
+				spUsage.release(source.ProviderID)
+				results <- raceResult{source: source, file: file, err: err}
+			}()
+			return true
+		}
+		return false
+	}
+
+	for i := 0; i < width; i++ {
+		if !startNext() {
+			break
+		}
+	}
+	if running == 0 {
+		return Source{}, fmt.Errorf("none of the %d sources for %s have a free retrieval slot", len(candidates), pieceCid)
+	}
+
+	for running > 0 {
+		res := <-results
+		running--
+
+		if res.err == nil {
+			res.err = os.Rename(res.file, dest)
+		}
+		if res.err == nil {
+			cancel()
+			go func(losers int) {
+				for i := 0; i < losers; i++ {
+					os.Remove((<-results).file)
+				}
+				// A cancelled loser may have been writing the piece's shared partial
+				removeSharedPartial(filepath.Dir(dest), pieceCid)
+			}(running)
+			return res.source, nil
+		}
+
+		log.Debugf("racer %s for %v failed: %s", res.source.ProviderID, pieceCid, res.err)
+		errs = append(errs, fmt.Sprintf("%s: %s", res.source.ProviderID, res.err))
+		os.Remove(res.file)
+		startNext()
+	}
+
+	return Source{}, fmt.Errorf("racing sources for %s failed: %s", pieceCid, strings.Join(errs, "; "))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/big"
+)
+
+// Serves a piece from each provider after a delay, for testing races between sources
+type delayedRetrievalBackend struct {
+	delays map[string]time.Duration // providers missing here don't have the piece
+	prices map[string]int64
+
+	mu        sync.Mutex
+	started   []string
+	cancelled []string
+}
+
+func (b *delayedRetrievalBackend) Name() string {
+	return "delayed"
+}
+
+func (b *delayedRetrievalBackend) Query(ctx context.Context, pieceCid string, payloadCid string, pieceSize int64, source Source) (RetrievalOffer, error) {
+	if _, found := b.delays[source.ProviderID]; !found {
+		return RetrievalOffer{}, fmt.Errorf("%s does not have %s", source.ProviderID, pieceCid)
+	}
+	return RetrievalOffer{Price: big.NewInt(b.prices[source.ProviderID])}, nil
+}
+
+func (b *delayedRetrievalBackend) Retrieve(ctx context.Context, pieceCid string, payloadCid string, pieceSize int64, source Source, dest string, progress RetrievalProgress) error {
+	b.mu.Lock()
+	b.started = append(b.started, source.ProviderID)
+	b.mu.Unlock()
+
+	delay, found := b.delays[source.ProviderID]
+	if !found || delay < 0 {
+		return fmt.Errorf("%s failed", source.ProviderID)
+	}
+
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.cancelled = append(b.cancelled, source.ProviderID)
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+
+	progress(4, 4)
+	return ioutil.WriteFile(dest, []byte(source.ProviderID), 0644)
+}
+
+func newRaceRegistry(b RetrievalBackend) *retrievalBackendRegistry {
+	r := &retrievalBackendRegistry{backends: make(map[string]RetrievalBackend)}
+	r.register(b)
+	r.setOrder("*=" + b.Name())
+	return r
+}
+
+func TestQueryOffersCheapestFirst(t *testing.T) {
+	b := &delayedRetrievalBackend{
+		delays: map[string]time.Duration{"f01": 0, "f02": 0, "f03": 0},
+		prices: map[string]int64{"f01": 5, "f02": 0, "f03": 5},
+	}
+	sources := []Source{{ProviderID: "f01"}, {ProviderID: "f04"}, {ProviderID: "f03"}, {ProviderID: "f02"}, {ProviderID: "f01"}}
+
+	candidates := queryOffers(context.Background(), newRaceRegistry(b), "piece", "payload", 1024, sources)
+
+	var got []string
+	for _, c := range candidates {
+		got = append(got, c.source.ProviderID)
+	}
+	if fmt.Sprint(got) != "[f02 f01 f03]" {
+		t.Errorf("expected [f02 f01 f03], got %v", got)
+	}
+}
+
+func TestRaceRetrievalFirstFinishWins(t *testing.T) {
+	b := &delayedRetrievalBackend{
+		delays: map[string]time.Duration{"f01": time.Minute, "f02": 10 * time.Millisecond, "f03": -1, "f04": 0},
+	}
+	candidates := []raceCandidate{{source: Source{ProviderID: "f01"}}, {source: Source{ProviderID: "f02"}}, {source: Source{ProviderID: "f03"}}, {source: Source{ProviderID: "f04"}}}
+	usage := &syncMap{m: map[string]uint{"f04": 1}}
+	dest := filepath.Join(t.TempDir(), "piece.car")
+
+	source, err := raceRetrieval(context.Background(), newRaceRegistry(b), "piece", "payload", 1024, candidates, 2, usage, 1, dest, func(int64, int64) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.ProviderID != "f02" {
+		t.Errorf("expected f02 to win, got %s", source.ProviderID)
+	}
+	if data, _ := ioutil.ReadFile(dest); string(data) != "f02" {
+		t.Errorf("expected the winner's CAR at dest, got %q", data)
+	}
+
+	// The slow racer is cancelled, and every slot is handed back
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		done := len(b.cancelled) == 1 && usage.getValue("f01") == 0
+		b.mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b.cancelled == nil || b.cancelled[0] != "f01" {
+		t.Errorf("expected f01 to be cancelled, got %v", b.cancelled)
+	}
+	if usage.getValue("f01") != 0 || usage.getValue("f02") != 0 || usage.getValue("f04") != 1 {
+		t.Errorf("sp usage not released: %v", usage.m)
+	}
+
+	// f04 was at its limit, so it is never started
+	for _, sp := range b.started {
+		if sp == "f04" {
+			t.Error("f04 should have been skipped")
+		}
+	}
+	if _, err := os.Stat(dest + ".f01.race"); !os.IsNotExist(err) {
+		t.Error("expected the loser's file to be removed")
+	}
+}
+
+func TestRaceRetrievalRemovesSharedPartial(t *testing.T) {
+	b := &delayedRetrievalBackend{delays: map[string]time.Duration{"f01": 0}}
+	candidates := []raceCandidate{{source: Source{ProviderID: "f01"}}}
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "piece.car")
+
+	// Left by an earlier attempt that failed
+	shared := partialPath(dir, "piece")
+	ioutil.WriteFile(shared, make([]byte, 100), 0644)
+	savePartial(shared, partialDownload{PieceCid: "piece", Offset: 100})
+
+	if _, err := raceRetrieval(context.Background(), newRaceRegistry(b), "piece", "payload", 1024, candidates, 1, &syncMap{m: make(map[string]uint)}, 1, dest, func(int64, int64) {}); err != nil {
+		t.Fatal(err)
+	}
+	if FileExists(shared) || FileExists(partialMetaPath(shared)) {
+		t.Error("expected the shared partial to be removed once the piece was retrieved")
+	}
+}
+
+func TestRaceRetrievalAllFail(t *testing.T) {
+	b := &delayedRetrievalBackend{delays: map[string]time.Duration{"f01": -1, "f02": -1, "f03": -1}}
+	candidates := []raceCandidate{{source: Source{ProviderID: "f01"}}, {source: Source{ProviderID: "f02"}}, {source: Source{ProviderID: "f03"}}}
+	usage := &syncMap{m: make(map[string]uint)}
+
+	_, err := raceRetrieval(context.Background(), newRaceRegistry(b), "piece", "payload", 1024, candidates, 2, usage, 1, filepath.Join(t.TempDir(), "piece.car"), func(int64, int64) {})
+	if err == nil {
+		t.Fatal("expected the race to fail")
+	}
+	if len(b.started) != 3 {
+		t.Errorf("expected failed racers to be replaced until all were tried, got %v", b.started)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Providers need at least this many (decayed) results before they can be skipped as chronically failing
+const reputationMinSamples = 5
+
+// How a retrieval attempt from a source SP went
+type retrievalOutcome int
+
+const (
+	outcomeSuccess retrievalOutcome = iota
+	outcomeOfferFailed
+	outcomeRejected
+	outcomeTimeout
+	outcomeFailed
+)
+
+// Returned (wrapped) by backends when the SP turns the retrieval down, or stops sending data
+var errRetrievalRejected = errors.New("retrieval rejected")
+var errRetrievalTimeout = errors.New("retrieval timed out")
+
+// Returned (wrapped) when we refuse an offer ourselves, e.g. over price or budget. Not held against the SP
+var errOfferRefused = errors.New("offer refused")
+
+func classifyRetrievalError(err error) retrievalOutcome {
+	switch {
+	case errors.Is(err, errRetrievalRejected):
+		return outcomeRejected
+	case errors.Is(err, errRetrievalTimeout):
+		return outcomeTimeout
+	default:
+		return outcomeFailed
+	}
+}
+
+// How a source SP has behaved recently. Counts decay over time, so old failures are forgiven
+type spReputation struct {
+	Successes      float64   `json:"successes"`
+	OfferFailures  float64   `json:"offer_failures"`
+	Rejections     float64   `json:"rejections"`
+	Timeouts       float64   `json:"timeouts"`
+	Failures       float64   `json:"failures"` // Any other failed retrieval, including bad CARs
+	TTFBSeconds    float64   `json:"ttfb_seconds"`
+	BytesPerSecond float64   `json:"bytes_per_second"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+func (r *spReputation) decay(now time.Time, halfLife time.Duration) {
+	if r.UpdatedAt.IsZero() || halfLife <= 0 {
+		r.UpdatedAt = now
+		return
+	}
+
+	factor := math.Pow(0.5, float64(now.Sub(r.UpdatedAt))/float64(halfLife))
+	r.Successes *= factor
+	r.OfferFailures *= factor
+	r.Rejections *= factor
+	r.Timeouts *= factor
+	r.Failures *= factor
+	r.UpdatedAt = now
+}
+
+func (r *spReputation) failures() float64 {
+	return r.OfferFailures + r.Rejections + r.Timeouts + r.Failures
+}
+
+// Share of attempts that succeeded, starting from an even chance for providers we know little about
+func (r *spReputation) successRate() float64 {
+	return (r.Successes + 1) / (r.Successes + r.failures() + 2)
+}
+
+// Keeps the reputation of each source SP. Scores are saved with the time they were last updated,
+// so an SP that was failing before a restart doesn't start over with a clean slate
+type reputationStore struct {
+	mu sync.Mutex
+
+	sps            map[string]*spReputation
+	halfLife       time.Duration
+	minSuccessRate float64
+	state          *persistedState
+}
+
+var spReputations = newReputationStore()
+
+func newReputationStore() *reputationStore {
+	s := &reputationStore{sps: make(map[string]*spReputation)}
+	s.state = newPersistedState("sp-reputation.json", &s.mu, &s.sps, stateSaveDelay)
+	return s
+}
+
+// Loads the decay and skip settings from config, and the reputations from the state directory
+func InitReputation(cfg EvergreenDealbotConfig) error {
+	s := spReputations
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.halfLife = time.Duration(cfg.Lotus.ReputationHalfLife) * time.Hour
+	s.minSuccessRate = cfg.Lotus.ReputationMinSuccessRate
+	return s.state.load(cfg.Common.StateLocation)
+}
+
+// Records the outcome of a retrieval attempt. For successes, ttfb is the time until the first data
+// arrived, and size bytes were retrieved in elapsed
+func (s *reputationStore) record(sp string, outcome retrievalOutcome, ttfb time.Duration, size int64, elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, found := s.sps[sp]
+	if !found {
+		r = &spReputation{}
+		s.sps[sp] = r
+	}
+	r.decay(time.Now(), s.halfLife)
+
+	switch outcome {
+	case outcomeSuccess:
+		r.Successes++
+		if ttfb > 0 {
+			r.TTFBSeconds = smoothSample(r.TTFBSeconds, ttfb.Seconds())
+		}
+		if size > 0 && elapsed > 0 {
+			r.BytesPerSecond = smoothSample(r.BytesPerSecond, float64(size)/elapsed.Seconds())
+		}
+	case outcomeOfferFailed:
+		r.OfferFailures++
+	case outcomeRejected:
+		r.Rejections++
+	case outcomeTimeout:
+		r.Timeouts++
+	default:
+		r.Failures++
+	}
+	s.state.changed()
+}
+
+// Moving average that starts from the first sample
+func smoothSample(average float64, sample float64) float64 {
+	if average == 0 {
+		return sample
+	}
+	return smoothTiming(average, sample, 1)
+}
+
+// Returns a copy of an SP's reputation, decayed to now
+func (s *reputationStore) get(sp string) spReputation {
+	if s == nil {
+		return spReputation{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, found := s.sps[sp]
+	if !found {
+		return spReputation{}
+	}
+	copied := *r
+	copied.decay(time.Now(), s.halfLife)
+	return copied
+}
+
+// Higher is better. Mostly the success rate, with faster providers ahead of equally reliable ones
+func (s *reputationStore) score(sp string) float64 {
+	r := s.get(sp)
+	speed := 0.0
+	if r.BytesPerSecond > 0 {
+		// Approaches 1 for providers well above 10MiB/s
+		speed = r.BytesPerSecond / (r.BytesPerSecond + 10<<20)
+	}
+	return r.successRate() + 0.1*speed
+}
+
+// Whether an SP has failed often enough recently that it isn't worth trying
+func (s *reputationStore) chronic(sp string) bool {
+	if s == nil || s.minSuccessRate <= 0 {
+		return false
+	}
+
+	r := s.get(sp)
+	return r.Successes+r.failures() >= reputationMinSamples && r.successRate() < s.minSuccessRate
+}
+
+// Orders sources best reputation first, for trying them when there is no offer to go by
+// Each SP is listed once, and chronically failing ones are left out
+func (s *reputationStore) rank(sources []Source) []Source {
+	var ranked []Source
+	scores := make(map[string]float64)
+	for _, source := range sources {
+		if _, seen := scores[source.ProviderID]; seen {
+			continue
+		}
+		scores[source.ProviderID] = s.score(source.ProviderID)
+
+		if s.chronic(source.ProviderID) {
+			continue
+		}
+		ranked = append(ranked, source)
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return scores[ranked[i].ProviderID] > scores[ranked[j].ProviderID]
+	})
+	return ranked
+}
+
+// Number of SPs tracked, and how many of them are skipped as chronically failing
+func (s *reputationStore) summary() (int, int) {
+	s.mu.Lock()
+	sps := make([]string, 0, len(s.sps))
+	for sp := range s.sps {
+		sps = append(sps, sp)
+	}
+	s.mu.Unlock()
+
+	chronic := 0
+	for _, sp := range sps {
+		if s.chronic(sp) {
+			chronic++
+		}
+	}
+	return len(sps), chronic
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReputationDecay(t *testing.T) {
+	now := time.Now()
+	r := spReputation{Successes: 4, Timeouts: 2, UpdatedAt: now.Add(-48 * time.Hour)}
+
+	r.decay(now, 24*time.Hour)
+	if math.Abs(r.Successes-1) > 1e-9 || math.Abs(r.Timeouts-0.5) > 1e-9 {
+		t.Errorf("expected counts to halve twice, got %v successes and %v timeouts", r.Successes, r.Timeouts)
+	}
+	if !r.UpdatedAt.Equal(now) {
+		t.Errorf("expected the update time to move to now")
+	}
+}
+
+func TestReputationSuccessRate(t *testing.T) {
+	var unknown spReputation
+	if rate := unknown.successRate(); rate != 0.5 {
+		t.Errorf("expected an unknown provider to start at 0.5, got %v", rate)
+	}
+
+	r := spReputation{Successes: 8, Rejections: 1, Failures: 1}
+	if rate := r.successRate(); math.Abs(rate-0.75) > 1e-9 {
+		t.Errorf("expected a success rate of 0.75, got %v", rate)
+	}
+}
+
+func TestReputationChronic(t *testing.T) {
+	s := &reputationStore{sps: make(map[string]*spReputation), halfLife: 24 * time.Hour, minSuccessRate: 0.2}
+
+	for i := 0; i < 3; i++ {
+		s.record("f01", outcomeTimeout, 0, 0, 0)
+	}
+	if s.chronic("f01") {
+		t.Error("expected a provider with few results not to be skipped yet")
+	}
+
+	for i := 0; i < 3; i++ {
+		s.record("f01", outcomeRejected, 0, 0, 0)
+	}
+	if !s.chronic("f01") {
+		t.Error("expected a provider failing every retrieval to be skipped")
+	}
+
+	for i := 0; i < 6; i++ {
+		s.record("f02", outcomeSuccess, time.Second, 1<<20, time.Second)
+	}
+	if s.chronic("f02") {
+		t.Error("expected a provider succeeding every retrieval not to be skipped")
+	}
+
+	if tracked, chronic := s.summary(); tracked != 2 || chronic != 1 {
+		t.Errorf("expected 2 tracked and 1 chronic, got %d and %d", tracked, chronic)
+	}
+
+	s.minSuccessRate = 0
+	if s.chronic("f01") {
+		t.Error("expected no provider to be skipped with a minimum success rate of 0")
+	}
+}
+
+func TestReputationDecaysWhileStopped(t *testing.T) {
+	var cfg EvergreenDealbotConfig
+	cfg.Common.StateLocation = t.TempDir()
+	cfg.Lotus.ReputationHalfLife = 24
+	cfg.Lotus.ReputationMinSuccessRate = 0.2
+
+	// Saved by a dealbot that stopped two days ago, while f01 was failing everything
+	saved := map[string]*spReputation{
+		"f01": {Timeouts: 8, BytesPerSecond: 1 << 20, UpdatedAt: time.Now().Add(-48 * time.Hour)},
+	}
+	if err := SaveJSON(filepath.Join(cfg.Common.StateLocation, "sp-reputation.json"), saved); err != nil {
+		t.Fatal(err)
+	}
+
+	spReputations = newReputationStore()
+	if err := InitReputation(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	r := spReputations.get("f01")
+	if math.Abs(r.Timeouts-2) > 1e-6 || r.BytesPerSecond != 1<<20 {
+		t.Errorf("expected the timeouts to have halved twice and the speed to be kept, got %+v", r)
+	}
+	if spReputations.chronic("f01") {
+		t.Error("expected f01 to have too few recent results left to be skipped")
+	}
+}
+
+func TestQueryOffersRanksByReputation(t *testing.T) {
+	b := &delayedRetrievalBackend{
+		delays: map[string]time.Duration{"f01": 0, "f02": 0, "f03": 0, "f04": 0},
+		prices: map[string]int64{"f01": 5, "f02": 5, "f03": 0, "f04": 5},
+	}
+	r := newRaceRegistry(b)
+	r.reputation = &reputationStore{sps: make(map[string]*spReputation), halfLife: 24 * time.Hour, minSuccessRate: 0.2}
+
+	r.reputation.record("f01", outcomeFailed, 0, 0, 0)
+	r.reputation.record("f02", outcomeSuccess, 0, 0, 0)
+	for i := 0; i <= reputationMinSamples; i++ {
+		r.reputation.record("f04", outcomeTimeout, 0, 0, 0)
+	}
+
+	sources := []Source{{ProviderID: "f01"}, {ProviderID: "f02"}, {ProviderID: "f03"}, {ProviderID: "f04"}}
+	candidates := queryOffers(context.Background(), r, "piece", "payload", 1024, sources)
+
+	var got []string
+	for _, c := range candidates {
+		got = append(got, c.source.ProviderID)
+	}
+	if fmt.Sprint(got) != "[f03 f02 f01]" {
+		t.Errorf("expected [f03 f02 f01], got %v", got)
+	}
+}
+
+func TestReputationRanksSources(t *testing.T) {
+	s := &reputationStore{sps: make(map[string]*spReputation), halfLife: 24 * time.Hour, minSuccessRate: 0.2}
+	s.record("f01", outcomeFailed, 0, 0, 0)
+	s.record("f02", outcomeSuccess, 0, 0, 0)
+	for i := 0; i <= reputationMinSamples; i++ {
+		s.record("f04", outcomeTimeout, 0, 0, 0)
+	}
+
+	sources := []Source{{ProviderID: "f01"}, {ProviderID: "f02"}, {ProviderID: "f03"}, {ProviderID: "f04"}, {ProviderID: "f02"}}
+	var got []string
+	for _, source := range s.rank(sources) {
+		got = append(got, source.ProviderID)
+	}
+	if fmt.Sprint(got) != "[f02 f03 f01]" {
+		t.Errorf("expected [f02 f03 f01], got %v", got)
+	}
+}
+
+func TestRetrievalRecordsReputation(t *testing.T) {
+	b := &delayedRetrievalBackend{delays: map[string]time.Duration{"f01": 0, "f02": -1}}
+	r := newRaceRegistry(b)
+	r.reputation = &reputationStore{sps: make(map[string]*spReputation)}
+	dir := t.TempDir()
+
+	for _, sp := range []string{"f01", "f02"} {
+		r.Retrieve(context.Background(), "piece", "payload", 1024, Source{ProviderID: sp}, filepath.Join(dir, sp), func(int64, int64) {})
+	}
+	r.Query(context.Background(), "piece", "payload", 1024, Source{ProviderID: "f03"})
+
+	if rep := r.reputation.get("f01"); rep.Successes != 1 || rep.failures() != 0 {
+		t.Errorf("expected one success for f01, got %+v", rep)
+	}
+	if rep := r.reputation.get("f02"); rep.Successes != 0 || rep.Failures != 1 {
+		t.Errorf("expected one failure for f02, got %+v", rep)
+	}
+	if rep := r.reputation.get("f03"); rep.OfferFailures != 1 {
+		t.Errorf("expected one offer failure for f03, got %+v", rep)
+	}
+}
+
+func TestRetrievalRecordsFailedVerificationOnce(t *testing.T) {
+	b := &delayedRetrievalBackend{delays: map[string]time.Duration{"f01": 0}}
+	r := newRaceRegistry(b)
+	r.reputation = &reputationStore{sps: make(map[string]*spReputation)}
+	r.breakers = newBreakerBoard(time.Minute, time.Hour, 24*time.Hour)
+	r.verify = func(pieceCid string, payloadCid string, pieceSize int64, source Source, path string) error {
+		return fmt.Errorf("%w: no blocks", errInvalidCar)
+	}
+
+	err := r.Retrieve(context.Background(), "piece", "payload", 1024, Source{ProviderID: "f01"}, filepath.Join(t.TempDir(), "f01"), func(int64, int64) {})
+	if err == nil || !strings.Contains(err.Error(), errInvalidCar.Error()) {
+		t.Fatalf("expected the verification error, got %v", err)
+	}
+	if rep := r.reputation.get("f01"); rep.Successes != 0 || rep.Failures != 1 {
+		t.Errorf("expected a single failure for f01, got %+v", rep)
+	}
+	if breaker := r.breakers.states.Pairs[pairKey("piece", "f01")]; breaker == nil || breaker.Failures != 1 {
+		t.Errorf("expected a single failure for the pair, got %+v", breaker)
+	}
+}
+
+func TestClassifyRetrievalError(t *testing.T) {
+	cases := map[error]retrievalOutcome{
+		fmt.Errorf("%w: deal rejected", errRetrievalRejected):                     outcomeRejected,
+		fmt.Errorf("stalled at byte 10: %w, no data for 1m", errRetrievalTimeout): outcomeTimeout,
+		fmt.Errorf("connection reset"):                                            outcomeFailed,
+	}
+	for err, expected := range cases {
+		if got := classifyRetrievalError(err); got != expected {
+			t.Errorf("%s: expected outcome %d, got %d", err, expected, got)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/big"
+	log "github.com/sirupsen/logrus"
+)
+
+// Called with the bytes received so far, and the total size if known (or -1)
+type RetrievalProgress func(received int64, total int64)
+
+// What a source SP will charge to retrieve a piece over a backend
+type RetrievalOffer struct {
+	Backend string
+	Price   big.Int
+}
+
+// A transport that can fetch a piece from a source SP into a local file
+// Query checks whether the SP will serve the piece without transferring it
+type RetrievalBackend interface {
+	Name() string
+	Query(ctx context.Context, pieceCid string, payloadCid string, pieceSize int64, source Source) (RetrievalOffer, error)
+	Retrieve(ctx context.Context, pieceCid string, payloadCid string, pieceSize int64, source Source, dest string, progress RetrievalProgress) error
+}
+
+// Known retrieval backends, and the order to try them in for each Source.SourceType
+type retrievalBackendRegistry struct {
+	mu sync.RWMutex
+
+	backends     map[string]RetrievalBackend
+	order        map[string][]string
+	defaultOrder []string
+
+	// Where the outcome of each retrieval and query is recorded, if set
+	reputation *reputationStore
+	breakers   *breakerBoard
+
+	// Checks a retrieved CAR before the retrieval counts as a success, if set
+	verify func(pieceCid string, payloadCid string, pieceSize int64, source Source, path string) error
+}
+
+var retrievalBackends = &retrievalBackendRegistry{
+	backends: make(map[string]RetrievalBackend),
+	order:    make(map[string][]string),
+}
+
+// Registers the built-in backends, and loads the fallback order from RETRIEVAL_BACKENDS
+func InitRetrievalBackends(cfg EvergreenDealbotConfig) error {
+	retrievalBackends.register(&httpRetrievalBackend{cfg: cfg})
+	retrievalBackends.register(&graphsyncRetrievalBackend{cfg: cfg})
+	retrievalBackends.reputation = spReputations
+	retrievalBackends.breakers = sourceBreakers
+	retrievalBackends.verify = func(pieceCid string, payloadCid string, pieceSize int64, source Source, path string) error {
+		activeJobs.setStage(pieceCid, jobVerifying, source.ProviderID)
+		return VerifyCar(path, pieceCid, payloadCid, pieceSize, source.ProviderID, cfg)
+	}
+
+	err := retrievalBackends.setOrder(cfg.Lotus.RetrievalBackends)
+	if err != nil {
+		return fmt.Errorf("parsing RETRIEVAL_BACKENDS: %s", err)
+	}
+	return nil
+}
+
+func (r *retrievalBackendRegistry) register(b RetrievalBackend) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backends[b.Name()] = b
+}
+
+// Parses "<source type>=<backend>,<backend>;..." where a "*" source type sets the order for unlisted types
+// Every backend named must be registered
+func (r *retrievalBackendRegistry) setOrder(s string) error {
+	order := make(map[string][]string)
+	var defaultOrder []string
+
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("expected <source type>=<backend>,..., got %q", entry)
+		}
+
+		var names []string
+		for _, name := range strings.Split(parts[1], ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if _, known := r.backend(name); !known {
+				return fmt.Errorf("unknown retrieval backend %q", name)
+			}
+			names = append(names, name)
+		}
+
+		sourceType := strings.TrimSpace(parts[0])
+		if sourceType == "*" {
+			defaultOrder = names
+		} else {
+			order[sourceType] = names
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.order = order
+	r.defaultOrder = defaultOrder
+	return nil
+}
+
+func (r *retrievalBackendRegistry) backend(name string) (RetrievalBackend, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	b, found := r.backends[name]
+	return b, found
+}
+
+// Returns the backends to try for a source type, in order
+func (r *retrievalBackendRegistry) forSourceType(sourceType string) []RetrievalBackend {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names, found := r.order[sourceType]
+	if !found {
+		names = r.defaultOrder
+	}
+
+	result := make([]RetrievalBackend, 0, len(names))
+	for _, name := range names {
+		result = append(result, r.backends[name])
+	}
+	return result
+}
+
+// Tries each backend configured for the source's type in turn, until one of them retrieves a CAR that passes
+// verification. The outcome is recorded against the source SP, unless the retrieval was cancelled or we
+// refused the offer
+// Sources whose circuit breakers don't let the attempt through aren't tried
+func (r *retrievalBackendRegistry) Retrieve(ctx context.Context, pieceCid string, payloadCid string, pieceSize int64, source Source, dest string, progress RetrievalProgress) error {
+	backends := r.forSourceType(source.SourceType)
+	if len(backends) == 0 {
+		return fmt.Errorf("no retrieval backends configured for source type %q", source.SourceType)
+	}
+	if !r.breakers.startSource(pieceCid, source.ProviderID) {
+		return fmt.Errorf("circuit breakers for %s from %s are open", pieceCid, source.ProviderID)
+	}
+
+	start := time.Now()
+	var firstByteMu sync.Mutex
+	var firstByte time.Time
+	timedProgress := func(n int64, total int64) {
+		if n > 0 {
+			firstByteMu.Lock()
+			if firstByte.IsZero() {
+				firstByte = time.Now()
+			}
+			firstByteMu.Unlock()
+		}
+		progress(n, total)
+	}
+
+	var errs []string
+	var lastErr error
+	for _, b := range backends {
+		err := b.Retrieve(ctx, pieceCid, payloadCid, pieceSize, source, dest, timedProgress)
+		if err == nil && r.verify != nil {
+			err = r.verify(pieceCid, payloadCid, pieceSize, source, dest)
+		}
+		if err == nil {
+			ttfb := time.Duration(0)
+			firstByteMu.Lock()
+			if !firstByte.IsZero() {
+				ttfb = firstByte.Sub(start)
+			}
+			firstByteMu.Unlock()
+
+			size := int64(0)
+			if info, err := os.Stat(dest); err == nil {
+				size = info.Size()
+			}
+			r.reputation.record(source.ProviderID, outcomeSuccess, ttfb, size, time.Since(start))
+			r.breakers.sourceSucceeded(pieceCid, source.ProviderID)
+			removeSharedPartial(filepath.Dir(dest), pieceCid)
+			return nil
+		}
+
+		log.Debugf("%s retrieval of %s from %s failed: %s", b.Name(), pieceCid, source.ProviderID, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", b.Name(), err))
+		if !errors.Is(err, errOfferRefused) {
+			lastErr = err
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if lastErr != nil && ctx.Err() == nil {
+		r.reputation.record(source.ProviderID, classifyRetrievalError(lastErr), 0, 0, 0)
+		r.breakers.sourceFailed(pieceCid, source.ProviderID)
+	} else {
+		r.breakers.sourceAbandoned(pieceCid, source.ProviderID)
+	}
+
+	return fmt.Errorf("retrieving %s from %s failed: %s", pieceCid, source.ProviderID, strings.Join(errs, "; "))
+}
+
+// Asks each backend configured for the source's type in turn for an offer, returning the first one made
+func (r *retrievalBackendRegistry) Query(ctx context.Context, pieceCid string, payloadCid string, pieceSize int64, source Source) (RetrievalOffer, error) {
+	backends := r.forSourceType(source.SourceType)
+	if len(backends) == 0 {
+		return RetrievalOffer{}, fmt.Errorf("no retrieval backends configured for source type %q", source.SourceType)
+	}
+
+	var errs []string
+	refused := false
+	for _, b := range backends {
+		offer, err := b.Query(ctx, pieceCid, payloadCid, pieceSize, source)
+		if err == nil {
+			offer.Backend = b.Name()
+			return offer, nil
+		}
+
+		errs = append(errs, fmt.Sprintf("%s: %s", b.Name(), err))
+		refused = refused || errors.Is(err, errOfferRefused)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if !refused && ctx.Err() == nil {
+		r.reputation.record(source.ProviderID, outcomeOfferFailed, 0, 0, 0)
+	}
+
+	return RetrievalOffer{}, fmt.Errorf("no offer for %s from %s: %s", pieceCid, source.ProviderID, strings.Join(errs, "; "))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/big"
+)
+
+// Serves pieces from memory, for tests that shouldn't touch lotus or the network
+type memoryRetrievalBackend struct {
+	name   string
+	pieces map[string][]byte
+	calls  int
+}
+
+func (b *memoryRetrievalBackend) Name() string {
+	return b.name
+}
+
+func (b *memoryRetrievalBackend) Query(ctx context.Context, pieceCid string, payloadCid string, pieceSize int64, source Source) (RetrievalOffer, error) {
+	if _, found := b.pieces[pieceCid]; !found {
+		return RetrievalOffer{}, fmt.Errorf("%s does not have %s", b.name, pieceCid)
+	}
+	return RetrievalOffer{Price: big.Zero()}, nil
+}
+
+func (b *memoryRetrievalBackend) Retrieve(ctx context.Context, pieceCid string, payloadCid string, pieceSize int64, source Source, dest string, progress RetrievalProgress) error {
+	b.calls++
+
+	data, found := b.pieces[pieceCid]
+	if !found {
+		return fmt.Errorf("%s does not have %s", b.name, pieceCid)
+	}
+
+	progress(int64(len(data)), int64(len(data)))
+	return ioutil.WriteFile(dest, data, 0644)
+}
+
+func TestRetrievalBackendFallback(t *testing.T) {
+	empty := &memoryRetrievalBackend{name: "empty"}
+	full := &memoryRetrievalBackend{name: "full", pieces: map[string][]byte{"piece": []byte("car data")}}
+
+	r := &retrievalBackendRegistry{backends: make(map[string]RetrievalBackend)}
+	r.register(empty)
+	r.register(full)
+
+	if err := r.setOrder("Filecoin=empty,full; *=empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "piece.car")
+	var received int64
+	err := r.Retrieve(context.Background(), "piece", "payload", 1024, Source{SourceType: "Filecoin"}, dest, func(r int64, total int64) {
+		received = r
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.calls != 1 || full.calls != 1 {
+		t.Errorf("expected both backends to be tried once, got %d and %d", empty.calls, full.calls)
+	}
+	if received != 8 {
+		t.Errorf("expected progress for 8 bytes, got %d", received)
+	}
+
+	// Unlisted source types use the default order, which only has the empty backend
+	if err := r.Retrieve(context.Background(), "piece", "payload", 1024, Source{SourceType: "Other"}, dest, func(int64, int64) {}); err == nil {
+		t.Error("expected the default order to fail")
+	}
+	if full.calls != 1 {
+		t.Error("backend outside the default order should not be tried")
+	}
+}
+
+func TestRetrievalBackendOrderErrors(t *testing.T) {
+	r := &retrievalBackendRegistry{backends: make(map[string]RetrievalBackend)}
+	r.register(&memoryRetrievalBackend{name: "http"})
+
+	for _, order := range []string{"*=http,ftp", "Filecoin"} {
+		if err := r.setOrder(order); err == nil {
+			t.Errorf("expected %q to be rejected", order)
+		}
+	}
+
+	if err := r.setOrder(""); err != nil {
+		t.Fatal(err)
+	}
+	if backends := r.forSourceType("Filecoin"); len(backends) != 0 {
+		t.Errorf("expected no backends without an order, got %d", len(backends))
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long a change to saved state may wait before it is written, so trackers that change on every
+// retrieval rewrite their file once per burst of changes instead of every time
+const stateSaveDelay = 10 * time.Second
+
+// A tracker's state, saved as a JSON file in STATE_LOCATION
+// The tracker's own lock guards the value, and must be held when calling load and changed
+type persistedState struct {
+	file  string
+	lock  sync.Locker
+	value interface{} // Pointer to the state
+	delay time.Duration
+
+	mu      sync.Mutex
+	path    string // Set once loaded, nothing is saved before then
+	pending bool
+}
+
+// Saves the value value points to as file, once changed is called. Changes are written after delay,
+// or straight away if it is 0
+func newPersistedState(file string, lock sync.Locker, value interface{}, delay time.Duration) *persistedState {
+	return &persistedState{file: file, lock: lock, value: value, delay: delay}
+}
+
+// Reads the state saved in dir, leaving the value untouched if nothing has been saved yet
+func (s *persistedState) load(dir string) error {
+	path := filepath.Join(dir, s.file)
+	if err := LoadJSON(path, s.value); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.path = path
+	s.mu.Unlock()
+	return nil
+}
+
+// Saves the state after a change, or schedules it to be saved
+func (s *persistedState) changed() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.path == "" || s.pending {
+		s.mu.Unlock()
+		return
+	}
+	if s.delay > 0 {
+		s.pending = true
+		time.AfterFunc(s.delay, s.flush)
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	s.write()
+}
+
+// Writes a scheduled change now, if there is one
+func (s *persistedState) flush() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = false
+	s.mu.Unlock()
+
+	if pending {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.write()
+	}
+}
+
+// Called with the tracker's lock held
+func (s *persistedState) write() {
+	if err := SaveJSON(s.path, s.value); err != nil {
+		log.Errorf("saving %s: %s", s.file, err)
+	}
+}
+
+// Loads the settings and saved state of the trackers the dealbot threads use
+func InitTrackers(cfg EvergreenDealbotConfig) error {
+	trackers := []struct {
+		name string
+		init func(EvergreenDealbotConfig) error
+	}{
+		{"tenant policy", InitTenantPolicy},
+		{"deal deadlines", InitDealDeadlines},
+		{"retrieval ledger", InitRetrievalLedger},
+		{"sp reputation", InitReputation},
+		{"circuit breakers", InitBreakers},
+	}
+
+	for _, t := range trackers {
+		if err := t.init(cfg); err != nil {
+			return fmt.Errorf("loading %s: %s", t.name, err)
+		}
+	}
+	return nil
+}
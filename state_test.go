@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPersistedStateWritesOncePerDelay(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "counts.json")
+
+	var mu sync.Mutex
+	counts := map[string]int{}
+	s := newPersistedState("counts.json", &mu, &counts, time.Hour)
+
+	// Nothing is saved before the state has been loaded
+	counts["a"] = 1
+	s.changed()
+	if FileExists(path) {
+		t.Fatal("expected nothing to be saved before loading")
+	}
+
+	if err := s.load(dir); err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= 3; i++ {
+		mu.Lock()
+		counts["a"] = i
+		s.changed()
+		mu.Unlock()
+	}
+	if FileExists(path) {
+		t.Fatal("expected the changes to wait for the delay")
+	}
+
+	s.flush()
+	var saved map[string]int
+	if err := LoadJSON(path, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved["a"] != 3 {
+		t.Errorf("expected the latest change to be saved, got %v", saved)
+	}
+}
+
+func TestPersistedStateWritesImmediately(t *testing.T) {
+	dir := t.TempDir()
+
+	var mu sync.Mutex
+	counts := map[string]int{"a": 1}
+	if err := SaveJSON(filepath.Join(dir, "counts.json"), counts); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := map[string]int{}
+	s := newPersistedState("counts.json", &mu, &loaded, 0)
+	if err := s.load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if loaded["a"] != 1 {
+		t.Fatalf("expected the saved state to be loaded, got %v", loaded)
+	}
+
+	loaded["b"] = 2
+	s.changed()
+
+	var saved map[string]int
+	if err := LoadJSON(filepath.Join(dir, "counts.json"), &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved["b"] != 2 {
+		t.Errorf("expected the change to be saved straight away, got %v", saved)
+	}
+}
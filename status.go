@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Periodically logs a summary of the dealbot state
+func StatusThread(cfg EvergreenDealbotConfig) {
+	interval := time.Duration(cfg.Common.StatusInterval) * time.Minute
+
+	for {
+		time.Sleep(interval)
+		logStatus()
+	}
+}
+
+func logStatus() {
+	snapshot := dealList.current()
+	if snapshot == nil {
+		log.Info("status: available deals list not loaded yet")
+	} else {
+		log.Infof("status: %d available deals from epoch %d, snapshot age %v",
+			len(snapshot.deals), snapshot.stateEpoch, dealList.Age().Truncate(time.Second))
+	}
+
+	if headroom, known := pendingBytes.Headroom(); known {
+		log.Infof("status: evergreen pending bytes headroom %d bytes", headroom)
+	} else {
+		log.Info("status: evergreen pending bytes cap not known yet")
+	}
+
+	if tracked, chronic := spReputations.summary(); tracked > 0 {
+		log.Infof("status: %d source SPs with a retrieval reputation, %d skipped as chronically failing", tracked, chronic)
+	}
+
+	for _, line := range sourceBreakers.summary() {
+		log.Info("status: " + line)
+	}
+
+	if report, ran := janitor.lastReport(); ran {
+		log.Infof("status: janitor last ran %v ago, %s", time.Since(report.At).Truncate(time.Second), report)
+	}
+
+	for _, job := range activeJobs.list() {
+		deadline, estimated := dealDeadlines.Deadline(job.PieceCid, job.Size)
+		toDeadline := "deadline not known yet"
+		if !deadline.IsZero() {
+			toDeadline = fmt.Sprintf("%v to deal start", time.Until(deadline).Truncate(time.Minute))
+			if estimated {
+				toDeadline += " (estimated)"
+			}
+		}
+
+		stage := job.Stage
+		if job.Source != "" {
+			stage += " from " + job.Source
+		}
+		if job.Received > 0 {
+			stage += fmt.Sprintf(" (%d of %d bytes)", job.Received, job.Size)
+		}
+
+		log.Infof("status: job %s %s for %v, %s", job.PieceCid, stage,
+			time.Since(job.StartedAt).Truncate(time.Second), toDeadline)
+	}
+}
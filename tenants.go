@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bytes imported on behalf of a tenant
+type tenantUsage struct {
+	TotalBytes int64  `json:"total_bytes"`
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+}
+
+// Enforces tenant allow/deny lists and per-tenant byte quotas when picking pieces
+// Usage is counted from successful imports. It is saved, as total quotas are for the life of the dealbot
+type tenantTracker struct {
+	mu sync.Mutex
+
+	allow map[int64]bool
+	deny  map[int64]bool
+
+	dailyQuota        map[int64]int64
+	defaultDailyQuota int64
+	totalQuota        map[int64]int64
+	defaultTotalQuota int64
+
+	usage    map[int64]*tenantUsage
+	reserved map[int64]int64
+	state    *persistedState
+}
+
+var tenantPolicy = newTenantTracker()
+
+func newTenantTracker() *tenantTracker {
+	t := &tenantTracker{
+		allow:    make(map[int64]bool),
+		deny:     make(map[int64]bool),
+		usage:    make(map[int64]*tenantUsage),
+		reserved: make(map[int64]int64),
+	}
+	t.state = newPersistedState("tenant-usage.json", &t.mu, &t.usage, stateSaveDelay)
+	return t
+}
+
+// Loads the tenant lists and quotas from config, and the recorded usage from the state directory
+func InitTenantPolicy(cfg EvergreenDealbotConfig) error {
+	t := tenantPolicy
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, id := range cfg.Evergreen.TenantAllow {
+		t.allow[id] = true
+	}
+	for _, id := range cfg.Evergreen.TenantDeny {
+		t.deny[id] = true
+	}
+
+	var err error
+	t.dailyQuota, t.defaultDailyQuota, err = parseTenantQuotas(cfg.Evergreen.TenantDailyQuota)
+	if err != nil {
+		return fmt.Errorf("parsing TENANT_DAILY_QUOTA_BYTES: %s", err)
+	}
+	t.totalQuota, t.defaultTotalQuota, err = parseTenantQuotas(cfg.Evergreen.TenantTotalQuota)
+	if err != nil {
+		return fmt.Errorf("parsing TENANT_TOTAL_QUOTA_BYTES: %s", err)
+	}
+
+	return t.state.load(cfg.Common.StateLocation)
+}
+
+// Parses "<tenant>=<bytes>,..." quotas, where a "*" tenant sets the default for unlisted tenants
+// A quota of 0 means unlimited
+func parseTenantQuotas(s string) (map[int64]int64, int64, error) {
+	quotas := make(map[int64]int64)
+	var defaultQuota int64 = 0
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, 0, fmt.Errorf("expected <tenant>=<bytes>, got %q", entry)
+		}
+
+		quota, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid quota %q: %s", parts[1], err)
+		}
+
+		tenant := strings.TrimSpace(parts[0])
+		if tenant == "*" {
+			defaultQuota = quota
+			continue
+		}
+
+		id, err := strconv.ParseInt(tenant, 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid tenant id %q: %s", tenant, err)
+		}
+		quotas[id] = quota
+	}
+
+	return quotas, defaultQuota, nil
+}
+
+func (t *tenantTracker) isAllowed(id int64) bool {
+	if t.deny[id] {
+		return false
+	}
+	return len(t.allow) == 0 || t.allow[id]
+}
+
+// Returns the usage for a tenant, resetting the daily counter when the day rolls over
+func (t *tenantTracker) usageFor(id int64) *tenantUsage {
+	u, found := t.usage[id]
+	if !found {
+		u = &tenantUsage{}
+		t.usage[id] = u
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	if u.Day != today {
+		u.Day = today
+		u.DayBytes = 0
+	}
+	return u
+}
+
+func quotaFor(quotas map[int64]int64, defaultQuota int64, id int64) int64 {
+	if q, found := quotas[id]; found {
+		return q
+	}
+	return defaultQuota
+}
+
+func (t *tenantTracker) hasQuota(id int64, size int64) bool {
+	u := t.usageFor(id)
+	pending := t.reserved[id] + size
+
+	if q := quotaFor(t.dailyQuota, t.defaultDailyQuota, id); q > 0 && u.DayBytes+pending > q {
+		return false
+	}
+	if q := quotaFor(t.totalQuota, t.defaultTotalQuota, id); q > 0 && u.TotalBytes+pending > q {
+		return false
+	}
+	return true
+}
+
+// Picks a tenant of the deal that is allowed and has quota left, reserving the piece size against it
+// Returns false if no tenant can take the piece. Reservations must be released with release()
+func (t *tenantTracker) reserve(d EvergreenDeal) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Pieces not tied to any tenant are only taken when no allow list is configured
+	if len(d.Tenants) == 0 {
+		return 0, len(t.allow) == 0
+	}
+
+	for _, id := range d.Tenants {
+		if !t.isAllowed(id) || !t.hasQuota(id, d.PaddedPieceSize) {
+			continue
+		}
+
+		t.reserved[id] += d.PaddedPieceSize
+		return id, true
+	}
+
+	return 0, false
+}
+
+// Whether the tenant lists allow taking deals for a tenant, whatever its quota
+// Tenant 0 stands for no tenant, which is only allowed without an allow list
+func (t *tenantTracker) allows(id int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.isAllowed(id)
+}
+
+func (t *tenantTracker) release(id int64, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.reserved[id] -= size
+	if t.reserved[id] <= 0 {
+		delete(t.reserved, id)
+	}
+}
+
+// Counts a successfully imported deal against its tenant's quotas
+func (t *tenantTracker) recordImport(id int64, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u := t.usageFor(id)
+	u.DayBytes += size
+	u.TotalBytes += size
+	t.state.changed()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+)
+
+func newTestTenantTracker(t *testing.T, allow []int64, deny []int64, daily string, total string) *tenantTracker {
+	tracker := &tenantTracker{
+		allow:    make(map[int64]bool),
+		deny:     make(map[int64]bool),
+		usage:    make(map[int64]*tenantUsage),
+		reserved: make(map[int64]int64),
+	}
+	for _, id := range allow {
+		tracker.allow[id] = true
+	}
+	for _, id := range deny {
+		tracker.deny[id] = true
+	}
+
+	var err error
+	if tracker.dailyQuota, tracker.defaultDailyQuota, err = parseTenantQuotas(daily); err != nil {
+		t.Fatal(err)
+	}
+	if tracker.totalQuota, tracker.defaultTotalQuota, err = parseTenantQuotas(total); err != nil {
+		t.Fatal(err)
+	}
+	return tracker
+}
+
+func TestTenantAllowDenyLists(t *testing.T) {
+	tracker := newTestTenantTracker(t, []int64{1, 2}, []int64{2}, "", "")
+
+	if _, ok := tracker.reserve(EvergreenDeal{Tenants: []int64{3}, PaddedPieceSize: 10}); ok {
+		t.Error("tenant not on the allow list should be rejected")
+	}
+	if _, ok := tracker.reserve(EvergreenDeal{Tenants: []int64{2}, PaddedPieceSize: 10}); ok {
+		t.Error("denied tenant should be rejected")
+	}
+	if id, ok := tracker.reserve(EvergreenDeal{Tenants: []int64{2, 1}, PaddedPieceSize: 10}); !ok || id != 1 {
+		t.Errorf("expected tenant 1 to be picked, got %d %v", id, ok)
+	}
+	if _, ok := tracker.reserve(EvergreenDeal{PaddedPieceSize: 10}); ok {
+		t.Error("pieces without tenants should be rejected when an allow list is set")
+	}
+
+	// Proposals are checked against the same lists before import
+	if !tracker.allows(1) || tracker.allows(2) || tracker.allows(3) {
+		t.Error("expected only tenant 1 to be allowed")
+	}
+}
+
+func TestTenantQuotas(t *testing.T) {
+	tracker := newTestTenantTracker(t, nil, nil, "*=100,7=0", "1=150")
+
+	// In-flight reservations count against the quota
+	id, ok := tracker.reserve(EvergreenDeal{Tenants: []int64{1}, PaddedPieceSize: 60})
+	if !ok {
+		t.Fatal("first piece should fit the quota")
+	}
+	if _, ok := tracker.reserve(EvergreenDeal{Tenants: []int64{1}, PaddedPieceSize: 60}); ok {
+		t.Error("second piece should exceed the daily quota while the first is in flight")
+	}
+
+	tracker.release(id, 60)
+	tracker.recordImport(id, 60)
+
+	if _, ok := tracker.reserve(EvergreenDeal{Tenants: []int64{1}, PaddedPieceSize: 40}); !ok {
+		t.Error("piece within the daily quota should be accepted")
+	}
+	if _, ok := tracker.reserve(EvergreenDeal{Tenants: []int64{1}, PaddedPieceSize: 60}); ok {
+		t.Error("piece exceeding the total quota should be rejected")
+	}
+
+	// Tenant 7 has its daily quota overridden to unlimited
+	if _, ok := tracker.reserve(EvergreenDeal{Tenants: []int64{7}, PaddedPieceSize: 1000}); !ok {
+		t.Error("unlimited tenant should be accepted")
+	}
+}
+
+func TestParseTenantQuotasRejectsGarbage(t *testing.T) {
+	if _, _, err := parseTenantQuotas("1:100"); err == nil {
+		t.Error("expected an error for a malformed entry")
+	}
+	if _, _, err := parseTenantQuotas("abc=100"); err == nil {
+		t.Error("expected an error for a malformed tenant id")
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
-	"math/rand"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -25,30 +28,70 @@ func ExecuteCommand(cmd string) string {
 	return string(out)
 }
 
-func randomIndex(length int) int {
-	rand.Seed(time.Now().UnixNano())
-	return rand.Intn(length)
-}
-
 // baga6ea4seaqbl2h2mamvynevzq2ohvvjjwg4hhtjaxp6w7mcfv5u2uc77etycfq.car
 func GenerateCarFileName(carDestination string, pieceCid string) string {
 	return carDestination + pieceCid + ".car"
 }
 
 // Resolves an issue in Go where redirected http requests will not have headers re-applied to them
-func PersistentHeaderHttpClient(originalRequest *http.Request) *http.Client {
+// The returned client pools its connections, so it should be created once and shared
+func PersistentHeaderHttpClient(timeout time.Duration, connectTimeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.MaxIdleConnsPerHost = 16
+
 	client := http.Client{
+		Timeout:   timeout,
+		Transport: transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			for key, values := range originalRequest.Header {
-				for _, value := range values {
-					req.Header.Add(key, value)
-				}
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			for key, values := range via[0].Header {
+				req.Header[key] = values
 			}
 			return nil
 		}}
 	return &client
 }
 
+// Writes v as JSON to path, replacing the file atomically so a crash never leaves it half written
+func SaveJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Reads JSON from path into v, leaving v untouched if the file does not exist yet
+func LoadJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parsing %s: %s", path, err)
+	}
+	return nil
+}
+
 func FileExists(filename string) bool {
 	if _, err := os.Stat(filename); err == nil {
 		return true
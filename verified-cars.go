@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// A CAR that passed verification, as it was on disk when it was verified
+type verifiedCar struct {
+	pieceCid   string
+	payloadCid string
+	paddedSize int64
+	size       int64
+	modTime    time.Time
+}
+
+// CARs that passed verification, by path, so the watcher doesn't hash every long-term CAR again each time it looks
+var verifiedCarsMu sync.Mutex
+var verifiedCars = make(map[string]verifiedCar)
+
+// Whether the CAR at path passed verification for the piece before, and hasn't changed since
+func carAlreadyVerified(path string, info os.FileInfo, pieceCid string, payloadCid string, paddedSize int64) bool {
+	verifiedCarsMu.Lock()
+	defer verifiedCarsMu.Unlock()
+
+	v, found := verifiedCars[path]
+	return found && v.pieceCid == pieceCid && v.payloadCid == payloadCid && v.paddedSize == paddedSize &&
+		v.size == info.Size() && v.modTime.Equal(info.ModTime())
+}
+
+// Records that the CAR at path passed verification, as it was when info was taken
+func rememberVerifiedCar(path string, info os.FileInfo, pieceCid string, payloadCid string, paddedSize int64) {
+	verifiedCarsMu.Lock()
+	defer verifiedCarsMu.Unlock()
+
+	verifiedCars[path] = verifiedCar{pieceCid, payloadCid, paddedSize, info.Size(), info.ModTime()}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifiedCarsForgetChangedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "piece.car")
+	if err := ioutil.WriteFile(path, []byte("car data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if carAlreadyVerified(path, info, "piece", "payload", 1024) {
+		t.Fatal("expected a CAR that was never verified to be checked")
+	}
+	rememberVerifiedCar(path, info, "piece", "payload", 1024)
+	if !carAlreadyVerified(path, info, "piece", "payload", 1024) {
+		t.Error("expected an unchanged CAR to be skipped")
+	}
+	if carAlreadyVerified(path, info, "other-piece", "payload", 1024) {
+		t.Error("expected the CAR to be checked again for another piece")
+	}
+
+	// Rewritten with the same size
+	if err := ioutil.WriteFile(path, []byte("new data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := info.ModTime().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	if carAlreadyVerified(path, info, "piece", "payload", 1024) {
+		t.Error("expected a changed CAR to be checked again")
+	}
+}